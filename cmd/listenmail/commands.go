@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/config"
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
+	"github.com/iamlongalong/listenmail/pkg/handlers"
+	"github.com/iamlongalong/listenmail/pkg/sources"
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// runValidateConfig checks the config file without starting anything
+func runValidateConfig(opts *cliOptions, args []string) error {
+	fs := newFlagSet("validate-config", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := opts.loadConfig()
+	var problems config.Problems
+	if errors.As(err, &problems) {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		return fmt.Errorf("%s: %d problem(s) found", opts.config, len(problems))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Users files and TLS certificates are only read when the source is created
+	for i, smtp := range cfg.Sources.SMTP {
+		if !smtp.Enabled {
+			continue
+		}
+		if _, err := sources.NewSMTPSource(smtp, nil); err != nil {
+			problems = append(problems, config.Problem{Path: fmt.Sprintf("sources.smtp[%d]", i), Message: err.Error()})
+		}
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		return fmt.Errorf("%s: %d problem(s) found", opts.config, len(problems))
+	}
+
+	fmt.Printf("%s: ok\n", opts.config)
+	return nil
+}
+
+// runImport reads mails from a .eml file, an mbox file or a maildir and stores them
+func runImport(opts *cliOptions, args []string) error {
+	fs := newFlagSet("import", "<file.eml|mbox|maildir>...")
+	dispatch := fs.Bool("dispatch", false, "run every handler on the imported mails instead of only saving them")
+	source := fs.String("source", "import", "source name recorded for the imported mails")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	config, err := opts.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var (
+		handle = func(*types.Mail) error { return nil }
+		done   = func() {}
+	)
+	if *dispatch {
+		p, err := newPipeline(config, false)
+		if err != nil {
+			return err
+		}
+		handle = p.disp.Dispatch
+		done = func() { p.shutdown(context.Background()) }
+	} else {
+		if err := os.MkdirAll(config.Save.Dir, 0755); err != nil {
+			return fmt.Errorf("create data directory error: %v", err)
+		}
+		save, err := handlers.NewSaveHandler(handlers.SaveConfig{
+			DBPath:        path.Join(config.Save.Dir, "emails.db"),
+			AttachmentDir: path.Join(config.Save.Dir, "attachments"),
+		})
+		if err != nil {
+			return err
+		}
+		handle = save.Handle
+		done = func() { save.Close() }
+	}
+	defer done()
+
+	// The save handler above has created the tables
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+
+	var imported, skipped, failed int
+	for _, file := range fs.Args() {
+		err := readMails(file, func(name string, raw []byte) {
+			mail, err := importMail(raw, *source)
+			if err == nil {
+				var exists bool
+				if exists, err = mailStored(db, mail); err == nil && exists {
+					skipped++
+					return
+				}
+			}
+			if err == nil {
+				err = handle(mail)
+			}
+			if err != nil {
+				log.Printf("import %s error: %v", name, err)
+				failed++
+				return
+			}
+			imported++
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("imported %d mail(s), %d already stored, %d failed\n", imported, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d mail(s) could not be imported", failed)
+	}
+	return nil
+}
+
+// importMail parses a raw mail, the ID is derived from the content so importing twice is recognisable
+// and mailStored skips it
+func importMail(raw []byte, source string) (*types.Mail, error) {
+	mail, err := utils.ParseMail(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parse mail error: %v", err)
+	}
+	sum := sha1.Sum(raw)
+	mail.ID = "import-" + hex.EncodeToString(sum[:8])
+	mail.Source = source
+	mail.Raw = raw
+	mail.Envelope = utils.EnvelopeFromHeaders(mail)
+	mail.Envelope.ReceivedAt = time.Now()
+	return mail, nil
+}
+
+// mailStored reports whether a mail with the same ID and source is already in the database
+func mailStored(db *gorm.DB, mail *types.Mail) (bool, error) {
+	var n int64
+	err := db.Model(&types.DBMail{}).Where("mail_id = ? AND source = ?", mail.ID, mail.Source).Count(&n).Error
+	if err != nil {
+		return false, fmt.Errorf("find stored mail error: %v", err)
+	}
+	return n > 0, nil
+}
+
+// readMails calls fn for every mail in a maildir, an mbox file or a single .eml file
+func readMails(file string, fn func(name string, raw []byte)) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return readMaildir(file, fn)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte("From ")) {
+		readMbox(file, data, fn)
+		return nil
+	}
+	fn(file, data)
+	return nil
+}
+
+// readMaildir reads cur/ and new/ of a maildir, or every file of a plain directory
+func readMaildir(dir string, fn func(name string, raw []byte)) error {
+	dirs := []string{filepath.Join(dir, "cur"), filepath.Join(dir, "new")}
+	if _, err := os.Stat(dirs[0]); os.IsNotExist(err) {
+		dirs = []string{dir}
+	}
+
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			name := filepath.Join(d, entry.Name())
+			raw, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			fn(name, raw)
+		}
+	}
+	return nil
+}
+
+// readMbox splits an mbox file on its "From " lines, >From lines are unescaped as in mboxrd
+func readMbox(file string, data []byte, fn func(name string, raw []byte)) {
+	var (
+		buf   bytes.Buffer
+		n     int
+		blank = true
+	)
+	flush := func() {
+		if n > 0 {
+			fn(fmt.Sprintf("%s#%d", file, n), append([]byte(nil), bytes.TrimSuffix(buf.Bytes(), []byte("\n"))...))
+		}
+		buf.Reset()
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case blank && bytes.HasPrefix(line, []byte("From ")):
+				flush()
+				n++
+			case line[0] == '>' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")):
+				buf.Write(line[1:])
+			default:
+				buf.Write(line)
+			}
+			blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err != nil {
+			break
+		}
+	}
+	flush()
+}
+
+// runExport writes the stored mails as mbox or JSON lines
+func runExport(opts *cliOptions, args []string) error {
+	fs := newFlagSet("export", "")
+	format := fs.String("format", "mbox", "output format: mbox or jsonl")
+	output := fs.String("o", "", "output file, defaults to stdout")
+	since := fs.String("since", "", "only mails stored at or after this time (RFC 3339 or 2006-01-02)")
+	until := fs.String("until", "", "only mails stored before this time (RFC 3339 or 2006-01-02)")
+	source := fs.String("source", "", "only mails from this source")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "mbox" && *format != "jsonl" {
+		return fmt.Errorf("unknown format %q, expected mbox or jsonl", *format)
+	}
+
+	config, err := opts.loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+
+	query := db.Model(&types.DBMail{}).Order("id")
+	if *since != "" {
+		t, err := parseTime(*since)
+		if err != nil {
+			return fmt.Errorf("parse -since error: %v", err)
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if *until != "" {
+		t, err := parseTime(*until)
+		if err != nil {
+			return fmt.Errorf("parse -until error: %v", err)
+		}
+		query = query.Where("created_at < ?", t)
+	}
+	if *source != "" {
+		query = query.Where("source = ?", *source)
+	}
+	if *format == "jsonl" {
+		query = query.Preload(clause.Associations).Omit("raw")
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+
+	var exported, skipped int
+	var mails []*types.DBMail
+	err = query.FindInBatches(&mails, 100, func(tx *gorm.DB, batch int) error {
+		for _, m := range mails {
+			if *format == "jsonl" {
+				if err := enc.Encode(m.ToAPIMail()); err != nil {
+					return err
+				}
+				exported++
+				continue
+			}
+			if len(m.Raw) == 0 {
+				skipped++
+				continue
+			}
+			writeMboxMessage(w, m)
+			exported++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return fmt.Errorf("export mails error: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if skipped > 0 {
+		log.Printf("skipped %d mail(s) stored without raw content", skipped)
+	}
+	log.Printf("exported %d mail(s)", exported)
+	return nil
+}
+
+// writeMboxMessage writes one mail in mboxrd format
+func writeMboxMessage(w *bufio.Writer, m *types.DBMail) {
+	from := m.EnvelopeFrom
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	fmt.Fprintf(w, "From %s %s\n", from, m.CreatedAt.UTC().Format(time.ANSIC))
+
+	raw := bytes.ReplaceAll(m.Raw, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			w.WriteByte('>')
+		}
+		w.Write(line)
+	}
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		w.WriteByte('\n')
+	}
+	w.WriteByte('\n')
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// runReplay dispatches a stored mail to the handlers again
+func runReplay(opts *cliOptions, args []string) error {
+	fs := newFlagSet("replay", "<mail-id>")
+	only := fs.String("handlers", "", "comma separated handlers to run, defaults to every handler except save")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	config, err := opts.loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+
+	// The argument is the database ID shown in the web UI, or the ID assigned by the source
+	var stored types.DBMail
+	id := fs.Arg(0)
+	query := db.Where("mail_id = ?", id)
+	if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+		query = db.Where("id = ?", n)
+	}
+	if err := query.First(&stored).Error; err != nil {
+		return fmt.Errorf("find mail %s error: %v", id, err)
+	}
+	if len(stored.Raw) == 0 {
+		return fmt.Errorf("mail %s was stored without raw content and cannot be replayed", id)
+	}
+
+	mail, err := utils.RestoreMail(stored.Raw, stored.MailID, stored.Source, stored.Envelope())
+	if err != nil {
+		return fmt.Errorf("parse mail error: %v", err)
+	}
+	if stored.Tags != "" {
+		mail.Tags = strings.Split(stored.Tags, ",")
+	}
+
+	p, err := newPipeline(config, false)
+	if err != nil {
+		return err
+	}
+
+	// Keep only the selected handlers, the mail is already saved
+	keep := map[string]bool{}
+	for _, name := range strings.Split(*only, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			keep[name] = true
+		}
+	}
+	var remove []types.Handler
+	for _, info := range p.disp.Handlers() {
+		if len(keep) == 0 && info.Name != "save" || keep[info.Name] {
+			delete(keep, info.Name)
+			continue
+		}
+		remove = append(remove, p.disp.Handler(info.Name))
+	}
+	for name := range keep {
+		p.shutdown(context.Background())
+		return fmt.Errorf("handler %s: %w", name, dispatcher.ErrHandlerNotFound)
+	}
+	p.disp.RemoveHandlers(remove...)
+
+	err = p.disp.Dispatch(mail)
+	p.shutdown(context.Background())
+	if err != nil {
+		return fmt.Errorf("dispatch mail error: %v", err)
+	}
+	log.Printf("mail %s replayed", id)
+	return nil
+}
+
+// runSendTest sends a test mail, by default to the first enabled SMTP source
+func runSendTest(opts *cliOptions, args []string) error {
+	fs := newFlagSet("send-test", "")
+	server := fs.String("server", "", "SMTP server host:port, defaults to the first enabled SMTP source")
+	from := fs.String("from", "listenmail@localhost", "sender address")
+	to := fs.String("to", "test@localhost", "comma separated recipient addresses")
+	subject := fs.String("subject", "listenmail test", "subject of the test mail")
+	body := fs.String("body", "This is a test mail sent by listenmail send-test.", "body of the test mail")
+	username := fs.String("user", "", "SMTP AUTH username")
+	password := fs.String("password", "", "SMTP AUTH password")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *server == "" {
+		config, err := opts.loadConfig()
+		if err != nil {
+			return err
+		}
+		addr, err := smtpSourceAddr(config)
+		if err != nil {
+			return err
+		}
+		*server = addr
+	}
+
+	var recipients []string
+	for _, addr := range strings.Split(*to, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			recipients = append(recipients, addr)
+		}
+	}
+
+	forward, err := handlers.NewForwardHandler(handlers.ForwardConfig{
+		Server:   *server,
+		From:     *from,
+		To:       recipients,
+		Username: *username,
+		Password: *password,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", *subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%d.send-test@listenmail>\r\n", now.UnixNano())
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", *body)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := forward.HandleContext(ctx, &types.Mail{Raw: msg.Bytes()}); err != nil {
+		return err
+	}
+	log.Printf("test mail sent to %s via %s", strings.Join(recipients, ", "), *server)
+	return nil
+}
+
+// smtpSourceAddr returns a dialable address of the first enabled SMTP source
+func smtpSourceAddr(config *types.ConfigFile) (string, error) {
+	for _, cfg := range config.Sources.SMTP {
+		if !cfg.Enabled {
+			continue
+		}
+		if cfg.ImplicitTLS {
+			return "", fmt.Errorf("smtp source %s uses implicit TLS, pass -server", cfg.Name)
+		}
+		addr := cfg.Address
+		if addr == "" {
+			addr = ":smtp"
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", fmt.Errorf("smtp source %s address error: %v", cfg.Name, err)
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	return "", errors.New("no enabled smtp source, pass -server")
+}
+
+// runDB runs database maintenance commands
+func runDB(opts *cliOptions, args []string) error {
+	fs := newFlagSet("db", "migrate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "migrate" {
+		fs.Usage()
+		return errUsage
+	}
+
+	config, err := opts.loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.Save.Dir, 0755); err != nil {
+		return fmt.Errorf("create data directory error: %v", err)
+	}
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	if err := types.Migrate(db); err != nil {
+		return fmt.Errorf("migrate database error: %v", err)
+	}
+	fmt.Printf("%s: migrated\n", path.Join(config.Save.Dir, "emails.db"))
+	return nil
+}
+
+// openDB opens the database in save.dir
+func openDB(config *types.ConfigFile) (*gorm.DB, error) {
+	db, err := utils.OpenDB(path.Join(config.Save.Dir, "emails.db"))
+	if err != nil {
+		return nil, fmt.Errorf("open database error: %v", err)
+	}
+	return db, nil
+}
@@ -1,163 +1,103 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"path"
-	"syscall"
 
-	"github.com/iamlongalong/listenmail/handler"
-	"github.com/iamlongalong/listenmail/pkg/dispatcher"
-	"github.com/iamlongalong/listenmail/pkg/handlers"
-	"github.com/iamlongalong/listenmail/pkg/server"
-	"github.com/iamlongalong/listenmail/pkg/sources"
+	"github.com/iamlongalong/listenmail/pkg/config"
 	"github.com/iamlongalong/listenmail/pkg/types"
-	"gopkg.in/yaml.v3"
 )
 
-func main() {
-	if _, err := os.Stat("config.yaml"); os.IsNotExist(err) {
-		log.Printf("config.yaml not found, writing default.")
-		err = os.WriteFile("config.yaml", []byte(defaultConfig), os.ModePerm)
-		if err != nil {
-			log.Fatalf("Error write default config: %s", err)
-			return
-		}
-	}
-	// Read configuration
-	data, err := os.ReadFile("config.yaml")
-	if err != nil {
-		log.Fatalf("Error reading config: %v", err)
-		return
-	}
-
-	var config types.ConfigFile
-	if err = yaml.Unmarshal(data, &config); err != nil {
-		log.Fatalf("Error parsing config: %v", err)
-	}
-
-	// Create dispatcher
-	disp := dispatcher.New()
-	defer disp.Close() // 确保在程序退出时关闭dispatcher
-
-	// Add example handler
-	if err = disp.AddHandlers(
-		handlers.NewLogHandler(),
-		handler.SaveHandler(config.Save.Dir),
-		handler.CursorCodeHandler(),
-	); err != nil {
-		log.Fatalf("Error adding handler: %v", err)
-	}
-
-	// Create and start sources
-	var activeSources []types.Source
-
-	var src types.Source
+// cliOptions are the global flags shared by every command
+type cliOptions struct {
+	config         string
+	explicitConfig bool // -config 是否显式指定
+	dataDir        string
+}
 
-	for _, cfg := range config.Sources.SMTP {
-		if !cfg.Enabled {
-			continue
-		}
+// loadConfig reads and validates the config file and applies -data-dir
+func (o *cliOptions) loadConfig() (*types.ConfigFile, error) {
+	return config.Load(o.config, o.dataDir)
+}
 
-		src, err = sources.NewSMTPSource(cfg, disp)
-		if err != nil {
-			log.Printf("Error creating source %s: %v", cfg.Name, err)
-		}
-		if err = src.Start(); err != nil {
-			log.Printf("Error starting source %s: %v", cfg.Name, err)
-		}
-		activeSources = append(activeSources, src)
-	}
+// errUsage is returned by a command after printing its usage for invalid arguments
+var errUsage = errors.New("invalid arguments")
 
-	for _, cfg := range config.Sources.IMAP {
-		if !cfg.Enabled {
-			continue
-		}
+// command is a subcommand, args are the arguments after its name
+type command struct {
+	name  string
+	usage string
+	run   func(opts *cliOptions, args []string) error
+}
 
-		src, err = sources.NewIMAPSource(cfg, disp)
-		if err != nil {
-			log.Printf("Error creating source %s: %v", cfg.Name, err)
-		}
-		if err = src.Start(); err != nil {
-			log.Printf("Error starting source %s: %v", cfg.Name, err)
-		}
-		activeSources = append(activeSources, src)
-	}
+var commands = []command{
+	{"serve", "receive mails from the configured sources (default)", runServe},
+	{"validate-config", "check the config file and exit", runValidateConfig},
+	{"import", "import mails from a .eml file, an mbox file or a maildir", runImport},
+	{"export", "export stored mails as mbox or JSON lines", runExport},
+	{"replay", "dispatch a stored mail to the handlers again", runReplay},
+	{"send-test", "send a test mail to an SMTP server", runSendTest},
+	{"db", "database maintenance: db migrate", runDB},
+}
 
-	for _, cfg := range config.Sources.POP3 {
-		if !cfg.Enabled {
-			continue
+func main() {
+	opts := &cliOptions{}
+	flag.StringVar(&opts.config, "config", "config.yaml", "path of the config file")
+	flag.StringVar(&opts.dataDir, "data-dir", "", "data directory, overrides save.dir in the config file")
+	flag.Usage = usage
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			opts.explicitConfig = true
 		}
+	})
 
-		src, err = sources.NewPOP3Source(cfg, disp)
-		if err != nil {
-			log.Printf("Error creating source %s: %v", cfg.Name, err)
-		}
-		if err = src.Start(); err != nil {
-			log.Printf("Error starting source %s: %v", cfg.Name, err)
-		}
-		activeSources = append(activeSources, src)
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
-
-	for _, cfg := range config.Sources.MailHog {
-		if !cfg.Enabled {
-			continue
-		}
-
-		src, err = sources.NewMailHogSource(cfg, disp)
-		if err != nil {
-			log.Printf("Error creating source %s: %v", cfg.Name, err)
-		}
-		if err = src.Start(); err != nil {
-			log.Printf("Error starting source %s: %v", cfg.Name, err)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			err := cmd.run(opts, args)
+			switch {
+			case err == nil, errors.Is(err, flag.ErrHelp):
+			case errors.Is(err, errUsage):
+				os.Exit(2)
+			default:
+				log.Fatalf("%s: %v", name, err)
+			}
+			return
 		}
-		activeSources = append(activeSources, src)
 	}
 
-	activeSources = append(activeSources, src)
-
-	if len(activeSources) == 0 {
-		log.Fatal("No sources were started")
-	}
-
-	s, err := server.New(server.Config{
-		DBPath:        path.Join(config.Save.Dir, "emails.db"),
-		AttachmentDir: path.Join(config.Save.Dir, "attachments"),
-		Username:      config.Server.Username,
-		Password:      config.Server.Password,
-	})
-	if err != nil {
-		log.Fatalf("create server fail: %s", err)
-		return
-	}
-
-	go func() {
-		err = s.Run(config.Server.Addr)
-		if err != nil {
-			log.Fatalf("run server fail: %s", err)
-		}
-	}()
-
-	log.Println("listener is running...")
-
-	// Wait for interrupt signal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-
-	log.Println("Shutting down...")
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-	if err := s.Close(); err != nil {
-		log.Printf("Error stopping server: %v", err)
+// usage prints the global flags and the commands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: listenmail [-config file] [-data-dir dir] <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", cmd.name, cmd.usage)
 	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nRun 'listenmail <command> -h' for the arguments of a command.\n")
+}
 
-	// Stop all sources
-	for _, src := range activeSources {
-		if err := src.Stop(); err != nil {
-			log.Printf("Error stopping source %s: %v", src.Name(), err)
-		}
+// newFlagSet creates the flag set of a command, args describes its positional arguments
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: listenmail [-config file] [-data-dir dir] %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
 	}
+	return fs
 }
 
 var defaultConfig = `server:
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
+	"github.com/iamlongalong/listenmail/pkg/handlers"
+	"github.com/iamlongalong/listenmail/pkg/server"
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// watchConfig polls file and signals on the returned channel when the file changes
+func watchConfig(file string, interval time.Duration, done <-chan struct{}) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	go func() {
+		stat := func() (time.Time, int64) {
+			fi, err := os.Stat(file)
+			if err != nil {
+				return time.Time{}, -1
+			}
+			return fi.ModTime(), fi.Size()
+		}
+		lastMod, lastSize := stat()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mod, size := stat()
+				if size < 0 || (mod.Equal(lastMod) && size == lastSize) {
+					continue
+				}
+				lastMod, lastSize = mod, size
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
+
+// reloader applies a changed config file to the running process:
+// rules are swapped atomically, changed sources are restarted and the
+// server credentials are updated. Everything else needs a restart.
+type reloader struct {
+	ctx     context.Context // cancelled on shutdown
+	opts    *cliOptions
+	config  *types.ConfigFile
+	disp    *dispatcher.Dispatcher
+	sources *sourceManager
+	server  *server.Server
+	ruleEnv handlers.RuleEnv
+	rules   []types.Handler
+}
+
+// reload reads the config file again, an invalid file leaves the running config untouched
+func (r *reloader) reload() error {
+	config, err := r.opts.loadConfig()
+	if err != nil {
+		return err
+	}
+	rules, err := handlers.NewRules(config.Rules, r.ruleEnv)
+	if err != nil {
+		return fmt.Errorf("create rules error: %v", err)
+	}
+	if err := r.disp.ReplaceHandlers(r.rules, rules); err != nil {
+		return fmt.Errorf("replace rules error: %v", err)
+	}
+	r.rules = rules
+
+	timeout := r.config.Dispatcher.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, timeout)
+	defer cancel()
+	n := r.sources.apply(ctx, config)
+
+	r.server.SetAuth(config.Server.Username, config.Server.Password)
+
+	for name, changed := range map[string]bool{
+		"server.addr": config.Server.Addr != r.config.Server.Addr,
+		"save":        !reflect.DeepEqual(config.Save, r.config.Save),
+		"spool":       !reflect.DeepEqual(config.Spool, r.config.Spool),
+		"dispatcher":  !reflect.DeepEqual(config.Dispatcher, r.config.Dispatcher),
+	} {
+		if changed {
+			log.Printf("Config %s changed, restart to apply it", name)
+		}
+	}
+	// Keep the settings that were not applied so the warning repeats until restart
+	config.Server.Addr = r.config.Server.Addr
+	config.Save = r.config.Save
+	config.Spool = r.config.Spool
+	config.Dispatcher = r.config.Dispatcher
+	r.config = config
+
+	log.Printf("Config reloaded: %d rule(s), %d source(s) running", len(rules), n)
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/iamlongalong/listenmail/handler"
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
+	"github.com/iamlongalong/listenmail/pkg/handlers"
+	"github.com/iamlongalong/listenmail/pkg/server"
+	"github.com/iamlongalong/listenmail/pkg/sources"
+	"github.com/iamlongalong/listenmail/pkg/spool"
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// pipeline is the dispatcher with its handlers, shared by serve, import and replay
+type pipeline struct {
+	disp        *dispatcher.Dispatcher
+	queueFull   dispatcher.QueueFullPolicy
+	save        types.Handler
+	closeSave   func() error
+	ruleEnv     handlers.RuleEnv
+	rules       []types.Handler
+	deadLetters *dispatcher.DeadLetterStore
+	processing  *dispatcher.ProcessingStore
+}
+
+// newPipeline creates the dispatcher and registers the rules and built-in handlers.
+// Without retry, handler failures are returned by Dispatch instead of being dead-lettered,
+// so one-shot commands can report them
+func newPipeline(config *types.ConfigFile, retry bool) (*pipeline, error) {
+	policy, err := dispatcher.ParseQueueFullPolicy(config.Dispatcher.QueueFullPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("parse dispatcher config error: %v", err)
+	}
+	opts := []dispatcher.Option{
+		dispatcher.WithExecutionMode(dispatcher.ContinueOnError),
+		dispatcher.WithWorkers(config.Dispatcher.Workers),
+		dispatcher.WithQueueFullPolicy(policy),
+		dispatcher.WithHandlerTimeout(config.Dispatcher.HandlerTimeout),
+	}
+	if config.Dispatcher.QueueSize > 0 {
+		opts = append(opts, dispatcher.WithQueueSize(config.Dispatcher.QueueSize))
+	}
+	for name, n := range config.Dispatcher.HandlerConcurrency {
+		opts = append(opts, dispatcher.WithHandlerConcurrency(name, n))
+	}
+	for name, timeout := range config.Dispatcher.HandlerTimeouts {
+		opts = append(opts, dispatcher.WithHandlerTimeoutFor(name, timeout))
+	}
+
+	p := &pipeline{disp: dispatcher.New(opts...), queueFull: policy}
+	p.save, p.closeSave = handler.SaveHandler(config.Save.Dir)
+
+	// Rules from config.yaml go first so a drop action stops the built-in handlers
+	p.ruleEnv = handlers.RuleEnv{Save: p.save}
+	if p.rules, err = handlers.NewRules(config.Rules, p.ruleEnv); err != nil {
+		return nil, fmt.Errorf("create rules error: %v", err)
+	}
+	if err = p.disp.AddHandlers(p.rules...); err != nil {
+		return nil, fmt.Errorf("add rules error: %v", err)
+	}
+
+	// Add example handler
+	builtin := []types.Handler{handlers.NewLogHandler()}
+	// Save stores a mail once, so rules with a save action don't produce duplicates here
+	if !config.Save.RulesOnly {
+		builtin = append(builtin, p.save)
+	}
+	builtin = append(builtin, handler.CursorCodeHandler())
+	if err = p.disp.AddHandlers(builtin...); err != nil {
+		return nil, fmt.Errorf("add handler error: %v", err)
+	}
+
+	// Failed handler invocations are retried and dead-lettered in the database
+	dbPath := path.Join(config.Save.Dir, "emails.db")
+	if retry {
+		if p.deadLetters, err = dispatcher.NewDeadLetterStore(dbPath); err != nil {
+			return nil, fmt.Errorf("create dead letter store error: %v", err)
+		}
+		p.disp.EnableRetry(p.deadLetters, config.Dispatcher.Retry)
+	}
+
+	// Every handler's match result, duration and outcome is recorded per mail
+	if p.processing, err = dispatcher.NewProcessingStore(dbPath); err != nil {
+		return nil, fmt.Errorf("create processing store error: %v", err)
+	}
+	p.disp.RecordProcessing(p.processing)
+
+	return p, nil
+}
+
+// shutdown drains the dispatcher and closes the stores and the save handler's database
+func (p *pipeline) shutdown(ctx context.Context) {
+	if err := p.disp.Shutdown(ctx); err != nil {
+		log.Printf("Error draining dispatcher: %v", err)
+	}
+	if p.deadLetters != nil {
+		if err := p.deadLetters.Close(); err != nil {
+			log.Printf("Error closing dead letter store: %v", err)
+		}
+	}
+	if err := p.processing.Close(); err != nil {
+		log.Printf("Error closing processing store: %v", err)
+	}
+	if err := p.closeSave(); err != nil {
+		log.Printf("Error closing save handler: %v", err)
+	}
+}
+
+// runServe receives mails from the configured sources until SIGINT or SIGTERM
+func runServe(opts *cliOptions, args []string) error {
+	fs := newFlagSet("serve", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// 未指定 -config 时保持原来的行为，在当前目录生成默认配置
+	if !opts.explicitConfig {
+		if _, err := os.Stat(opts.config); os.IsNotExist(err) {
+			log.Printf("%s not found, writing default.", opts.config)
+			if err = os.WriteFile(opts.config, []byte(defaultConfig), 0644); err != nil {
+				return fmt.Errorf("write default config error: %v", err)
+			}
+		}
+	}
+
+	// Read configuration
+	config, err := opts.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	p, err := newPipeline(config, true)
+	if err != nil {
+		return err
+	}
+
+	// Create spool, sources write mails to disk before they are dispatched.
+	// The spool is the dispatcher's queue: it delivers with dispatcher.workers workers
+	// and applies queue_full_policy once queue_size mails are waiting
+	sp, err := spool.New(config.Spool, p.disp,
+		spool.WithWorkers(config.Dispatcher.Workers),
+		spool.WithQueueLimit(config.Dispatcher.QueueSize, p.queueFull))
+	if err != nil {
+		return fmt.Errorf("create spool error: %v", err)
+	}
+
+	// Sources continue from the sync progress saved before the last restart
+	state, err := sources.NewStateStore(path.Join(config.Save.Dir, "emails.db"))
+	if err != nil {
+		return fmt.Errorf("create sync state store error: %v", err)
+	}
+	defer state.Close()
+
+	// Create and start sources
+	srcs := newSourceManager(sp, state)
+	if srcs.apply(context.Background(), config) == 0 {
+		return errors.New("no sources were started")
+	}
+
+	s, err := server.New(server.Config{
+		DBPath:        path.Join(config.Save.Dir, "emails.db"),
+		AttachmentDir: path.Join(config.Save.Dir, "attachments"),
+		Username:      config.Server.Username,
+		Password:      config.Server.Password,
+		Handlers:      p.disp,
+		Sources:       srcs,
+	})
+	if err != nil {
+		return fmt.Errorf("create server error: %v", err)
+	}
+
+	go func() {
+		err := s.Run(config.Server.Addr)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("run server fail: %s", err)
+		}
+	}()
+
+	log.Println("listener is running...")
+
+	// Reload the config file on SIGHUP or when the file changes
+	reloadCtx, cancelReload := context.WithCancel(context.Background())
+	r := &reloader{
+		ctx:     reloadCtx,
+		opts:    opts,
+		config:  config,
+		disp:    p.disp,
+		sources: srcs,
+		server:  s,
+		ruleEnv: p.ruleEnv,
+		rules:   p.rules,
+	}
+	stopWatch := make(chan struct{})
+	changed := watchConfig(opts.config, 2*time.Second, stopWatch)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	// Reloads run one at a time outside the signal loop so SIGTERM is handled while
+	// sources restart; requests arriving during a reload are merged into one
+	reloadCh := make(chan struct{}, 1)
+	go func() {
+		for range reloadCh {
+			if err := r.reload(); err != nil {
+				log.Printf("Error reloading config, keeping the running config: %v", err)
+			}
+		}
+	}()
+
+	// Wait for interrupt signal
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+wait:
+	for {
+		select {
+		case <-sigCh:
+			break wait
+		case <-hupCh:
+			log.Println("SIGHUP received, reloading config")
+		case <-changed:
+			log.Printf("%s changed, reloading config", opts.config)
+		}
+		select {
+		case reloadCh <- struct{}{}:
+		default:
+		}
+	}
+	close(stopWatch)
+	close(reloadCh)
+	cancelReload() // a running reload stops waiting for sources, srcs.stop below stops them
+
+	log.Println("Shutting down...")
+
+	timeout := config.Dispatcher.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop sources first, SMTP stops accepting connections and waits for open sessions
+	srcs.stop(ctx)
+
+	// Drain spooled and queued mails, handlers still running at the deadline are cancelled
+	if err := sp.Shutdown(ctx); err != nil {
+		log.Printf("Error draining spool: %v", err)
+	}
+	p.shutdown(ctx)
+	sp.Close()
+
+	// The HTTP server goes last so the UI stays available while draining
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error stopping server: %v", err)
+	}
+	return nil
+}
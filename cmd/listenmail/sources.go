@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/iamlongalong/listenmail/pkg/sources"
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// sourceManager starts and stops mail sources. On reload only sources whose
+// config changed are restarted, so open SMTP sessions of the others survive.
+type sourceManager struct {
+	dispatcher types.Dispatcher
+	state      *sources.StateStore // sync progress of IMAP, POP3 and MailHog sources
+
+	mu      sync.RWMutex // guards running, order and stopped, read by /api/sources
+	running map[string]*runningSource
+	order   []string
+	stopped bool // set by stop, a reload finishing afterwards starts nothing
+}
+
+type runningSource struct {
+	config interface{}
+	source types.Source
+}
+
+// sourceSpec describes an enabled source in the config file
+type sourceSpec struct {
+	key    string
+	config interface{}
+	create func() (types.Source, error)
+}
+
+func newSourceManager(dispatcher types.Dispatcher, state *sources.StateStore) *sourceManager {
+	return &sourceManager{
+		dispatcher: dispatcher,
+		state:      state,
+		running:    make(map[string]*runningSource),
+	}
+}
+
+// specs lists the enabled sources of config, keyed by type and name
+func (m *sourceManager) specs(config *types.ConfigFile) []sourceSpec {
+	var specs []sourceSpec
+	for _, cfg := range config.Sources.SMTP {
+		if cfg.Enabled {
+			cfg := cfg
+			specs = append(specs, sourceSpec{"smtp/" + cfg.Name, *cfg, func() (types.Source, error) {
+				return sources.NewSMTPSource(cfg, m.dispatcher)
+			}})
+		}
+	}
+	for _, cfg := range config.Sources.IMAP {
+		if cfg.Enabled {
+			cfg := cfg
+			specs = append(specs, sourceSpec{"imap/" + cfg.Name, *cfg, func() (types.Source, error) {
+				return sources.NewIMAPSource(cfg, m.dispatcher)
+			}})
+		}
+	}
+	for _, cfg := range config.Sources.POP3 {
+		if cfg.Enabled {
+			cfg := cfg
+			specs = append(specs, sourceSpec{"pop3/" + cfg.Name, *cfg, func() (types.Source, error) {
+				return sources.NewPOP3Source(cfg, m.dispatcher)
+			}})
+		}
+	}
+	for _, cfg := range config.Sources.MailHog {
+		if cfg.Enabled {
+			cfg := cfg
+			specs = append(specs, sourceSpec{"mailhog/" + cfg.Name, *cfg, func() (types.Source, error) {
+				return sources.NewMailHogSource(cfg, m.dispatcher)
+			}})
+		}
+	}
+	return specs
+}
+
+// apply stops removed or changed sources and starts new or changed ones.
+// It returns the number of running sources. Sources are stopped and started
+// without holding the lock so a source that is slow to stop or start does
+// not block stop or the sources API; apply itself must not run concurrently.
+func (m *sourceManager) apply(ctx context.Context, config *types.ConfigFile) int {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return 0
+	}
+
+	var specs []sourceSpec
+	wanted := make(map[string]sourceSpec)
+	for _, spec := range m.specs(config) {
+		if _, ok := wanted[spec.key]; ok {
+			log.Printf("Duplicate source %s, only the first one is used", spec.key)
+			continue
+		}
+		wanted[spec.key] = spec
+		specs = append(specs, spec)
+	}
+
+	var stop []types.Source
+	order := m.order[:0]
+	for _, key := range m.order {
+		rs := m.running[key]
+		if spec, ok := wanted[key]; ok && reflect.DeepEqual(spec.config, rs.config) {
+			order = append(order, key)
+			continue
+		}
+		log.Printf("Stopping source %s", key)
+		stop = append(stop, rs.source)
+		delete(m.running, key)
+	}
+	m.order = order
+
+	var start []sourceSpec
+	for _, spec := range specs {
+		if _, ok := m.running[spec.key]; !ok {
+			start = append(start, spec)
+		}
+	}
+	m.mu.Unlock()
+
+	// Stop first so a restarted SMTP source can bind the same address again
+	for _, src := range stop {
+		stopSource(ctx, src)
+	}
+
+	for _, spec := range start {
+		src, err := spec.create()
+		if err != nil {
+			log.Printf("Error creating source %s: %v", spec.key, err)
+			continue
+		}
+		if ss, ok := src.(interface{ SetStateStore(*sources.StateStore) }); ok {
+			ss.SetStateStore(m.state)
+		}
+		if err = src.Start(); err != nil {
+			log.Printf("Error starting source %s: %v", spec.key, err)
+			continue
+		}
+
+		m.mu.Lock()
+		if m.stopped {
+			m.mu.Unlock()
+			stopSource(ctx, src)
+			return 0
+		}
+		m.running[spec.key] = &runningSource{config: spec.config, source: src}
+		m.order = append(m.order, spec.key)
+		m.mu.Unlock()
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.running)
+}
+
+// stop stops every running source
+func (m *sourceManager) stop(ctx context.Context) {
+	m.mu.Lock()
+	running := make([]types.Source, 0, len(m.order))
+	for _, key := range m.order {
+		running = append(running, m.running[key].source)
+	}
+	m.running = make(map[string]*runningSource)
+	m.order = nil
+	m.stopped = true
+	m.mu.Unlock()
+
+	for _, src := range running {
+		stopSource(ctx, src)
+	}
+}
+
+// Sources lists the running sources with their connection state. Sources
+// without a connection to track (SMTP) are reported as connected.
+func (m *sourceManager) Sources() []types.SourceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	statuses := make([]types.SourceStatus, 0, len(m.order))
+	for _, key := range m.order {
+		src := m.running[key].source
+		if sr, ok := src.(interface{ Status() types.SourceStatus }); ok {
+			statuses = append(statuses, sr.Status())
+			continue
+		}
+		typ := strings.SplitN(key, "/", 2)[0]
+		statuses = append(statuses, types.SourceStatus{Name: src.Name(), Type: typ, Connected: true})
+	}
+	return statuses
+}
+
+// stopSource stops src, SMTP stops accepting connections and waits for open sessions
+func stopSource(ctx context.Context, src types.Source) {
+	var err error
+	if gs, ok := src.(interface{ Shutdown(context.Context) error }); ok {
+		err = gs.Shutdown(ctx)
+	} else {
+		err = src.Stop()
+	}
+	if err != nil {
+		log.Printf("Error stopping source %s: %v", src.Name(), err)
+	}
+}
@@ -13,12 +13,15 @@ import (
 	"github.com/iamlongalong/listenmail/pkg/utils"
 )
 
-// SaveHandler 创建一个保存所有邮件到数据库的处理器
-func SaveHandler(dir string) types.Handler {
+// SaveHandler 创建一个保存所有邮件到数据库的处理器，返回的 close 关闭数据库连接，
+// 需要在所有邮件处理完成后调用。创建失败时处理器为 nil
+func SaveHandler(dir string) (types.Handler, func() error) {
+	noop := func() error { return nil }
+
 	// 确保数据目录存在
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		log.Printf("Error creating data directory: %v", err)
-		return nil
+		return nil, noop
 	}
 
 	// 创建保存处理器
@@ -28,15 +31,16 @@ func SaveHandler(dir string) types.Handler {
 	})
 	if err != nil {
 		log.Printf("Error creating save handler: %v", err)
-		return nil
+		return nil, noop
 	}
 
-	return handler
+	return handler, handler.Close
 }
 
 // CursorCodeHandler 创建一个处理 Cursor 相关邮件的处理器
 func CursorCodeHandler() types.Handler {
-	return handlers.NewHandler(
+	return handlers.NewNamedHandler(
+		"cursor_code",
 		// 处理函数
 		handlers.WrapHandlers(
 			func(m *types.Mail) error {
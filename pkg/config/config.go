@@ -0,0 +1,298 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem 是配置文件中的一个问题
+type Problem struct {
+	Path    string // YAML 路径，如 sources.imap[0].check_interval
+	Line    int    // 行号，未知时为 0
+	Message string
+}
+
+func (p Problem) String() string {
+	s := p.Path
+	if s == "" {
+		s = "config"
+	}
+	if p.Line > 0 {
+		s += fmt.Sprintf(" (line %d)", p.Line)
+	}
+	return s + ": " + p.Message
+}
+
+// Problems 汇总配置文件中的所有问题
+type Problems []Problem
+
+func (p Problems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = "  " + problem.String()
+	}
+	return fmt.Sprintf("%d problem(s) in config:\n%s", len(p), strings.Join(lines, "\n"))
+}
+
+func (p *Problems) add(path string, line int, format string, args ...interface{}) {
+	*p = append(*p, Problem{Path: path, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Load 读取并严格解析配置文件，替换环境变量、读取密码文件、填充默认值后校验，dataDir 不为空时覆盖 save.dir
+func Load(file, dataDir string) (*types.ConfigFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read config error: %v", err)
+	}
+
+	config, lines, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if dataDir != "" {
+		config.Save.Dir = dataDir
+	}
+	config.SetDefaults()
+
+	problems := readSecrets(config)
+	if err := Validate(config); err != nil {
+		var p Problems
+		if errors.As(err, &p) {
+			problems = append(problems, p...)
+		} else {
+			problems.add("", 0, "%v", err)
+		}
+	}
+	if len(problems) > 0 {
+		// 补充问题所在的行号，默认值引起的问题没有行号
+		for i := range problems {
+			problems[i].Line = lines[problems[i].Path]
+		}
+		return nil, problems
+	}
+	return config, nil
+}
+
+// Decode 严格解析配置，未知字段和类型错误都以 Problems 返回
+func Decode(data []byte) (*types.ConfigFile, error) {
+	config, _, err := decode(data)
+	return config, err
+}
+
+// decode 解析配置，同时返回每个 YAML 路径所在的行号
+func decode(data []byte) (*types.ConfigFile, map[string]int, error) {
+	var config types.ConfigFile
+	lines := make(map[string]int)
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, fmt.Errorf("parse config error: %v", err)
+	}
+	if len(root.Content) == 0 {
+		return &config, lines, nil
+	}
+
+	// ${VAR} 在检查字段之前替换，替换后的值按字段类型解析
+	c := &checker{lines: lines}
+	expandEnv(root.Content[0], "", &c.problems)
+	c.check(root.Content[0], reflect.TypeOf(config), "")
+	if len(c.problems) > 0 {
+		return nil, nil, c.problems
+	}
+
+	if err := root.Content[0].Decode(&config); err != nil {
+		return nil, nil, fmt.Errorf("parse config error: %v", err)
+	}
+	return &config, lines, nil
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// checker 按照配置结构检查 YAML 节点，记录未知字段、无法解析的值和每个路径的行号
+type checker struct {
+	problems Problems
+	lines    map[string]int
+}
+
+func (c *checker) check(node *yaml.Node, t reflect.Type, path string) {
+	problems := &c.problems
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if _, ok := c.lines[path]; !ok {
+		c.lines[path] = node.Line
+	}
+	if node.Tag == "!!null" {
+		return
+	}
+
+	switch {
+	case t == timeType, t.Kind() != reflect.Struct && t.Kind() != reflect.Slice && t.Kind() != reflect.Map:
+		if t.Kind() == reflect.Interface {
+			return
+		}
+		if t == durationType && node.Tag == "!!int" && node.Value != "0" {
+			problems.add(path, node.Line, "duration %s needs a unit, e.g. \"%ss\"", node.Value, node.Value)
+			return
+		}
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			problems.add(path, node.Line, "%s", decodeError(err))
+		}
+
+	case t.Kind() == reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			problems.add(path, node.Line, "expected a mapping")
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Tag == "!!merge" {
+				c.check(value, t, path)
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				msg := fmt.Sprintf("unknown field %q", key.Value)
+				if s := suggest(key.Value, fields); s != "" {
+					msg += fmt.Sprintf(", did you mean %q?", s)
+				}
+				problems.add(joinPath(path, key.Value), key.Line, "%s", msg)
+				continue
+			}
+			c.lines[joinPath(path, key.Value)] = key.Line
+			c.check(value, field, joinPath(path, key.Value))
+		}
+
+	case t.Kind() == reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		if node.Kind != yaml.SequenceNode {
+			problems.add(path, node.Line, "expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	case t.Kind() == reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			problems.add(path, node.Line, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			c.lines[joinPath(path, key.Value)] = key.Line
+			c.check(node.Content[i+1], t.Elem(), joinPath(path, key.Value))
+		}
+	}
+}
+
+// yamlFields 返回结构体中 YAML 字段名到类型的映射，规则与 yaml.v3 相同
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if len(tag) > 1 && tag[1] == "inline" {
+			for name, ft := range yamlFields(f.Type) {
+				fields[name] = ft
+			}
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// suggest 返回与 name 最接近的字段名，用于提示拼写错误
+func suggest(name string, fields map[string]reflect.Type) string {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	best, bestDist := "", len(name)/2+1
+	for _, field := range names {
+		if d := editDistance(name, field); d < bestDist {
+			best, bestDist = field, d
+		}
+	}
+	return best
+}
+
+// editDistance 计算两个字符串的编辑距离
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// decodeError 去掉 yaml 错误中的前缀和行号，行号由 Problem 单独记录
+func decodeError(err error) string {
+	if terr, ok := err.(*yaml.TypeError); ok && len(terr.Errors) > 0 {
+		msg := terr.Errors[0]
+		if i := strings.Index(msg, ": "); strings.HasPrefix(msg, "line ") && i > 0 {
+			msg = msg[i+2:]
+		}
+		return msg
+	}
+	return err.Error()
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile 在临时目录中写入文件并返回路径
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// problemAt 返回 path 上的问题，没有时测试失败
+func problemAt(t *testing.T, err error, path string) Problem {
+	t.Helper()
+	var problems Problems
+	if !errors.As(err, &problems) {
+		t.Fatalf("error = %v, want Problems", err)
+	}
+	for _, p := range problems {
+		if p.Path == path {
+			return p
+		}
+	}
+	t.Fatalf("no problem at %s in:\n%v", path, err)
+	return Problem{}
+}
+
+func TestDecodeUnknownField(t *testing.T) {
+	data := `save:
+  dir: ./data
+sources:
+  imap:
+    - name: work
+      chek_interval: 1m
+`
+	_, err := Decode([]byte(data))
+	p := problemAt(t, err, "sources.imap[0].chek_interval")
+	if p.Line != 6 {
+		t.Errorf("line = %d, want 6", p.Line)
+	}
+	if want := `unknown field "chek_interval", did you mean "check_interval"?`; p.Message != want {
+		t.Errorf("message = %q, want %q", p.Message, want)
+	}
+	if !strings.Contains(err.Error(), "sources.imap[0].chek_interval (line 6)") {
+		t.Errorf("error does not show the path and line:\n%v", err)
+	}
+}
+
+func TestDecodeExpandEnv(t *testing.T) {
+	t.Setenv("LM_TEST_DIR", "/var/lib/listenmail")
+	t.Setenv("LM_TEST_EMPTY", "")
+	t.Setenv("LM_TEST_WORKERS", "4")
+
+	data := `save:
+  dir: ${LM_TEST_DIR}
+dispatcher:
+  workers: ${LM_TEST_WORKERS}
+  queue_full_policy: ${LM_TEST_UNSET:-reject}
+sources:
+  smtp:
+    - name: ${LM_TEST_EMPTY:-inbound}
+      address: "127.0.0.1:$${PORT}"
+`
+	config, err := Decode([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"${VAR}", config.Save.Dir, "/var/lib/listenmail"},
+		{"${VAR} in an int field", config.Dispatcher.Workers, 4},
+		{"${UNSET:-def}", config.Dispatcher.QueueFullPolicy, "reject"},
+		{"${EMPTY:-def}", config.Sources.SMTP[0].Name, "inbound"},
+		{"$${", config.Sources.SMTP[0].Address, "127.0.0.1:${PORT}"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestDecodeUnsetEnv(t *testing.T) {
+	data := `save:
+  dir: ${LM_TEST_UNSET}
+`
+	_, err := Decode([]byte(data))
+	p := problemAt(t, err, "save.dir")
+	if p.Line != 2 || p.Message != "environment variable LM_TEST_UNSET is not set" {
+		t.Errorf("problem = %v", p)
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	password := writeFile(t, dir, "password", "s3cret\n")
+	refreshToken := writeFile(t, dir, "refresh_token", "rt-1\r\n")
+
+	config := writeFile(t, dir, "config.yaml", `save:
+  dir: `+dir+`
+sources:
+  imap:
+    - name: password
+      enabled: true
+      server: imap.example.com:993
+      username: user
+      password_file: `+password+`
+  pop3:
+    - name: oauth2
+      enabled: true
+      server: pop.example.com:995
+      username: user
+      oauth2:
+        token_url: https://oauth2.example.com/token
+        client_id: listenmail
+        refresh_token_file: `+refreshToken+`
+`)
+	loaded, err := Load(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Sources.IMAP[0].Password; got != "s3cret" {
+		t.Errorf("imap password = %q, want s3cret", got)
+	}
+	if got := loaded.Sources.POP3[0].OAuth2.RefreshToken; got != "rt-1" {
+		t.Errorf("pop3 refresh token = %q, want rt-1", got)
+	}
+}
+
+func TestLoadSecretFileProblems(t *testing.T) {
+	dir := t.TempDir()
+	password := writeFile(t, dir, "password", "s3cret")
+
+	config := writeFile(t, dir, "config.yaml", `save:
+  dir: `+dir+`
+sources:
+  imap:
+    - name: both
+      enabled: true
+      server: imap.example.com:993
+      username: user
+      password: inline
+      password_file: `+password+`
+    - name: missing
+      enabled: true
+      server: imap.example.com:993
+      username: user
+      password_file: `+filepath.Join(dir, "missing")+`
+`)
+	_, err := Load(config, "")
+	if p := problemAt(t, err, "sources.imap[0].password_file"); p.Line != 10 || p.Message != "set either password or password_file, not both" {
+		t.Errorf("problem = %v", p)
+	}
+	if p := problemAt(t, err, "sources.imap[1].password_file"); p.Line != 15 || !strings.HasPrefix(p.Message, "read secret error:") {
+		t.Errorf("problem = %v", p)
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// envPattern 匹配 ${VAR}、${VAR:-default} 和转义的 $${
+var envPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv 替换所有标量值中的环境变量，未设置且没有默认值的变量记为问题
+func expandEnv(node *yaml.Node, path string, problems *Problems) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, item := range node.Content {
+			itemPath := path
+			if node.Kind == yaml.SequenceNode {
+				itemPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+			expandEnv(item, itemPath, problems)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			expandEnv(node.Content[i+1], joinPath(path, node.Content[i].Value), problems)
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+		node.Value = envPattern.ReplaceAllStringFunc(node.Value, func(s string) string {
+			if s == "$${" {
+				return "${"
+			}
+			m := envPattern.FindStringSubmatch(s)
+			if value, ok := os.LookupEnv(m[1]); ok && (value != "" || m[2] == "") {
+				return value
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			problems.add(path, node.Line, "environment variable %s is not set", m[1])
+			return ""
+		})
+		// 未加引号的值按替换后的内容重新推断类型，如 ${PORT} 可以用于数字字段
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	}
+}
+
+// readSecrets 读取 *_file 字段指向的文件，内容末尾的换行会被去掉
+func readSecrets(config *types.ConfigFile) Problems {
+	var p Problems
+	readSecret(&p, "server", "password", &config.Server.Password, config.Server.PasswordFile)
+	for i, cfg := range config.Sources.IMAP {
+		if cfg != nil {
+			path := fmt.Sprintf("sources.imap[%d]", i)
+			readSecret(&p, path, "password", &cfg.Password, cfg.PasswordFile)
+			readOAuth2Secrets(&p, path, cfg.OAuth2)
+		}
+	}
+	for i, cfg := range config.Sources.POP3 {
+		if cfg != nil {
+			path := fmt.Sprintf("sources.pop3[%d]", i)
+			readSecret(&p, path, "password", &cfg.Password, cfg.PasswordFile)
+			readOAuth2Secrets(&p, path, cfg.OAuth2)
+		}
+	}
+	return p
+}
+
+func readOAuth2Secrets(p *Problems, path string, cfg *types.OAuth2Config) {
+	if cfg == nil {
+		return
+	}
+	path += ".oauth2"
+	readSecret(p, path, "client_secret", &cfg.ClientSecret, cfg.ClientSecretFile)
+	readSecret(p, path, "refresh_token", &cfg.RefreshToken, cfg.RefreshTokenFile)
+}
+
+// readSecret 读取 path 下 name_file 指向的文件到 name 字段
+func readSecret(p *Problems, path, name string, value *string, file string) {
+	if file == "" {
+		return
+	}
+	if *value != "" {
+		p.add(path+"."+name+"_file", 0, "set either %s or %s_file, not both", name, name)
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		p.add(path+"."+name+"_file", 0, "read secret error: %v", err)
+		return
+	}
+	*value = strings.TrimRight(string(data), "\r\n")
+}
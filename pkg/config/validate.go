@@ -0,0 +1,352 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
+	"github.com/iamlongalong/listenmail/pkg/handlers"
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// Validate 检查填充默认值后的配置，返回的 Problems 列出所有问题
+func Validate(config *types.ConfigFile) error {
+	var p Problems
+
+	validateServer(config, &p)
+	validateSpool(&config.Spool, &p)
+	validateDispatcher(&config.Dispatcher, &p)
+	validateRules(config.Rules, &p)
+	validateSources(config, &p)
+
+	if len(p) > 0 {
+		return p
+	}
+	return nil
+}
+
+func validateServer(config *types.ConfigFile, p *Problems) {
+	if config.Server.Addr != "" {
+		if _, _, err := net.SplitHostPort(config.Server.Addr); err != nil {
+			p.add("server.addr", 0, "invalid address %q: %v", config.Server.Addr, err)
+		}
+	}
+	if config.Server.Username != "" && config.Server.Password == "" {
+		p.add("server.password", 0, "required when server.username is set")
+	}
+}
+
+func validateSpool(config *types.SpoolConfig, p *Problems) {
+	notNegative(p, "spool.max_attempts", config.MaxAttempts)
+	notNegativeDuration(p, "spool.retry_backoff", config.RetryBackoff)
+}
+
+func validateDispatcher(config *types.DispatcherConfig, p *Problems) {
+	notNegative(p, "dispatcher.workers", config.Workers)
+	notNegative(p, "dispatcher.queue_size", config.QueueSize)
+	if policy, err := dispatcher.ParseQueueFullPolicy(config.QueueFullPolicy); err != nil {
+		p.add("dispatcher.queue_full_policy", 0, "%v", err)
+	} else if policy == dispatcher.QueueFullSpill && config.QueueSize > 0 {
+		p.add("dispatcher.queue_size", 0, "has no effect with queue_full_policy spill, every mail is written to the spool")
+	}
+	for name, n := range config.HandlerConcurrency {
+		if n <= 0 {
+			p.add("dispatcher.handler_concurrency."+name, 0, "must be positive, got %d", n)
+		}
+	}
+	notNegativeDuration(p, "dispatcher.handler_timeout", config.HandlerTimeout)
+	for name, timeout := range config.HandlerTimeouts {
+		notNegativeDuration(p, "dispatcher.handler_timeouts."+name, timeout)
+	}
+	notNegativeDuration(p, "dispatcher.shutdown_timeout", config.ShutdownTimeout)
+
+	notNegative(p, "dispatcher.retry.max_attempts", config.Retry.MaxAttempts)
+	notNegativeDuration(p, "dispatcher.retry.backoff", config.Retry.Backoff)
+	notNegativeDuration(p, "dispatcher.retry.max_backoff", config.Retry.MaxBackoff)
+	if config.Retry.MaxBackoff > 0 && config.Retry.MaxBackoff < config.Retry.Backoff {
+		p.add("dispatcher.retry.max_backoff", 0, "%s is smaller than backoff %s", config.Retry.MaxBackoff, config.Retry.Backoff)
+	}
+}
+
+// validateRules 逐条创建规则，save 动作用日志处理器代替
+func validateRules(rules []*types.RuleConfig, p *Problems) {
+	env := handlers.RuleEnv{Save: handlers.NewLogHandler()}
+	names := make(map[string]int, len(rules))
+	for i, rule := range rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if rule == nil || rule.Name == "" {
+			p.add(path+".name", 0, "required")
+			continue
+		}
+		if j, ok := names[rule.Name]; ok {
+			p.add(path+".name", 0, "duplicate rule name %q, also used by rules[%d]", rule.Name, j)
+		} else {
+			names[rule.Name] = i
+		}
+		if _, err := handlers.NewRule(rule, env); err != nil {
+			p.add(path, 0, "%v", err)
+		}
+	}
+}
+
+func validateSources(config *types.ConfigFile, p *Problems) {
+	// 邮件源名称记录在每封邮件中，不同类型的源也不能重名
+	names := make(map[string]string)
+	checkName := func(path, name string) {
+		if name == "" {
+			p.add(path+".name", 0, "required")
+			return
+		}
+		if other, ok := names[name]; ok {
+			p.add(path+".name", 0, "duplicate source name %q, also used by %s", name, other)
+			return
+		}
+		names[name] = path
+	}
+
+	// 启用的 SMTP 源和 web 服务不能监听同一个地址
+	var listeners []listener
+	if config.Server.Addr != "" {
+		listeners = append(listeners, listener{path: "server.addr", addr: config.Server.Addr})
+	}
+
+	for i, cfg := range config.Sources.SMTP {
+		path := fmt.Sprintf("sources.smtp[%d]", i)
+		if cfg == nil {
+			p.add(path, 0, "source is empty")
+			continue
+		}
+		checkName(path, cfg.Name)
+		validateSMTP(cfg, path, p)
+		if cfg.Enabled {
+			listeners = append(listeners, listener{path: path + ".address", addr: cfg.Address})
+		}
+	}
+	for i, cfg := range config.Sources.IMAP {
+		path := fmt.Sprintf("sources.imap[%d]", i)
+		if cfg == nil {
+			p.add(path, 0, "source is empty")
+			continue
+		}
+		checkName(path, cfg.Name)
+		validateMailbox(p, path, cfg.Enabled, cfg.Server, cfg.Username, cfg.Interval)
+		for j, folder := range cfg.Folders {
+			if folder == "" {
+				p.add(fmt.Sprintf("%s.folders[%d]", path, j), 0, "folder name is empty")
+			}
+		}
+		validateOAuth2(cfg.OAuth2, cfg.Password, path, p)
+		validateStartFrom(p, path, cfg.StartFrom)
+		validateIMAPSearch(&cfg.Search, path+".search", p)
+		validateIMAPActions(cfg, path+".actions", p)
+	}
+	for i, cfg := range config.Sources.POP3 {
+		path := fmt.Sprintf("sources.pop3[%d]", i)
+		if cfg == nil {
+			p.add(path, 0, "source is empty")
+			continue
+		}
+		checkName(path, cfg.Name)
+		validateMailbox(p, path, cfg.Enabled, cfg.Server, cfg.Username, cfg.Interval)
+		validateOAuth2(cfg.OAuth2, cfg.Password, path, p)
+		validateStartFrom(p, path, cfg.StartFrom)
+	}
+	for i, cfg := range config.Sources.MailHog {
+		path := fmt.Sprintf("sources.mailhog[%d]", i)
+		if cfg == nil {
+			p.add(path, 0, "source is empty")
+			continue
+		}
+		checkName(path, cfg.Name)
+		if u, err := url.Parse(cfg.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			p.add(path+".api_url", 0, "invalid URL %q, expected http(s)://host:port", cfg.APIURL)
+		}
+		positiveDuration(p, path+".check_interval", cfg.Interval)
+		validateStartFrom(p, path, cfg.StartFrom)
+	}
+
+	checkListeners(listeners, p)
+}
+
+func validateSMTP(cfg *types.SMTPConfig, path string, p *Problems) {
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		p.add(path+".address", 0, "invalid address %q: %v", cfg.Address, err)
+	}
+	notNegativeDuration(p, path+".read_timeout", cfg.ReadTimeout)
+	notNegativeDuration(p, path+".write_timeout", cfg.WriteTimeout)
+	if cfg.MaxMessageBytes < 0 {
+		p.add(path+".max_message_bytes", 0, "must not be negative, got %d", cfg.MaxMessageBytes)
+	}
+	notNegative(p, path+".max_recipients", cfg.MaxRecipients)
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		p.add(path, 0, "tls_cert and tls_key must be set together")
+	}
+	if cfg.TLSCert == "" && cfg.ImplicitTLS {
+		p.add(path+".implicit_tls", 0, "requires tls_cert and tls_key")
+	}
+	if cfg.TLSCert == "" && cfg.RequireTLS {
+		p.add(path+".require_tls", 0, "requires tls_cert and tls_key")
+	}
+	for j, user := range cfg.Users {
+		if user.Username == "" {
+			p.add(fmt.Sprintf("%s.users[%d].username", path, j), 0, "required")
+		}
+	}
+	if cfg.RequireAuth && len(cfg.Users) == 0 && cfg.UsersFile == "" {
+		p.add(path+".require_auth", 0, "requires users or users_file")
+	}
+	// go-smtp 只在 TLS 连接或 allow_insecure_auth 时声明 AUTH，否则客户端无法认证
+	if cfg.RequireAuth && cfg.TLSCert == "" && !cfg.AllowInsecureAuth {
+		p.add(path+".require_auth", 0, "requires tls_cert and tls_key or allow_insecure_auth, AUTH is only offered over TLS")
+	}
+}
+
+// validateMailbox 检查 IMAP 和 POP3 源，服务器和账号只在启用时必填
+func validateMailbox(p *Problems, path string, enabled bool, server, username string, interval time.Duration) {
+	positiveDuration(p, path+".check_interval", interval)
+	if !enabled {
+		return
+	}
+	if server == "" {
+		p.add(path+".server", 0, "required")
+	} else if _, _, err := net.SplitHostPort(server); err != nil {
+		p.add(path+".server", 0, "invalid address %q, expected host:port", server)
+	}
+	if username == "" {
+		p.add(path+".username", 0, "required")
+	}
+}
+
+// validateOAuth2 检查 IMAP 和 POP3 源的 oauth2，令牌来源只能设置一个
+func validateOAuth2(cfg *types.OAuth2Config, password, path string, p *Problems) {
+	if cfg == nil {
+		return
+	}
+	if password != "" {
+		p.add(path+".oauth2", 0, "cannot be used with password")
+	}
+	path += ".oauth2"
+	if cfg.Mechanism != types.OAuth2MechanismXOAuth2 && cfg.Mechanism != types.OAuth2MechanismOAuthBearer {
+		p.add(path+".mechanism", 0, "invalid mechanism %q, expected %s or %s", cfg.Mechanism, types.OAuth2MechanismXOAuth2, types.OAuth2MechanismOAuthBearer)
+	}
+
+	var set []string
+	for _, f := range []struct{ name, value string }{
+		{"token", cfg.Token},
+		{"token_file", cfg.TokenFile},
+		{"refresh_token", cfg.RefreshToken},
+	} {
+		if f.value != "" {
+			set = append(set, f.name)
+		}
+	}
+	switch {
+	case len(set) == 0:
+		p.add(path, 0, "requires one of token, token_file, refresh_token or refresh_token_file")
+	case len(set) > 1:
+		p.add(path, 0, "set only one of token, token_file or refresh_token, got %s", strings.Join(set, " and "))
+	}
+	if cfg.RefreshToken == "" {
+		return
+	}
+	if u, err := url.Parse(cfg.TokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p.add(path+".token_url", 0, "invalid URL %q, expected http(s)://host/path", cfg.TokenURL)
+	}
+	if cfg.ClientID == "" {
+		p.add(path+".client_id", 0, "required when refresh_token is set")
+	}
+}
+
+func validateStartFrom(p *Problems, path, startFrom string) {
+	if _, err := types.ParseStartFrom(startFrom); err != nil {
+		p.add(path+".start_from", 0, "%v", err)
+	}
+}
+
+func validateIMAPSearch(cfg *types.IMAPSearchConfig, path string, p *Problems) {
+	if _, err := cfg.SinceDate(); err != nil {
+		p.add(path+".since", 0, "%v", err)
+	}
+}
+
+func validateIMAPActions(cfg *types.IMAPConfig, path string, p *Problems) {
+	actions := &cfg.Actions
+	for j, flag := range actions.Flags {
+		// 标记是 atom，系统标记以 \ 开头
+		if name := strings.TrimPrefix(flag, "\\"); name == "" || strings.ContainsAny(name, " (){%*\"\\]") {
+			p.add(fmt.Sprintf("%s.flags[%d]", path, j), 0, "invalid flag %q", flag)
+		}
+	}
+	if actions.MoveTo == "" {
+		return
+	}
+	// 设置 \Deleted 后移动，邮件在目标文件夹中也是已删除状态
+	if actions.Delete {
+		p.add(path+".delete", 0, "cannot be used with move_to, moving already removes the mail from the folder")
+	}
+	// 移动到监听的文件夹会再次处理
+	for _, folder := range cfg.Folders {
+		if folder == actions.MoveTo {
+			p.add(path+".move_to", 0, "folder %q is also monitored, moved mails would be processed again", folder)
+		}
+	}
+}
+
+// listener 是一个监听地址及其在配置中的路径
+type listener struct {
+	path string
+	addr string
+}
+
+// checkListeners 报告端口相同且主机相同或为通配地址的监听地址
+func checkListeners(listeners []listener, p *Problems) {
+	type hostPort struct{ host, port string }
+	resolved := make([]*hostPort, len(listeners))
+	for i, l := range listeners {
+		host, port, err := net.SplitHostPort(l.addr)
+		if err != nil {
+			continue // 已在地址检查中报告
+		}
+		if n, err := net.LookupPort("tcp", port); err == nil {
+			port = fmt.Sprint(n)
+		}
+		resolved[i] = &hostPort{host, port}
+	}
+
+	wildcard := func(host string) bool {
+		return host == "" || host == "0.0.0.0" || host == "::"
+	}
+	for i := range listeners {
+		for j := 0; j < i; j++ {
+			a, b := resolved[i], resolved[j]
+			if a == nil || b == nil || a.port != b.port {
+				continue
+			}
+			if a.host == b.host || wildcard(a.host) || wildcard(b.host) {
+				p.add(listeners[i].path, 0, "address %q conflicts with %s (%q)", listeners[i].addr, listeners[j].path, listeners[j].addr)
+			}
+		}
+	}
+}
+
+func notNegative(p *Problems, path string, n int) {
+	if n < 0 {
+		p.add(path, 0, "must not be negative, got %d", n)
+	}
+}
+
+func notNegativeDuration(p *Problems, path string, d time.Duration) {
+	if d < 0 {
+		p.add(path, 0, "must not be negative, got %s", d)
+	}
+}
+
+func positiveDuration(p *Problems, path string, d time.Duration) {
+	if d <= 0 {
+		p.add(path, 0, "must be positive, got %s", d)
+	}
+}
@@ -0,0 +1,59 @@
+package dispatcher
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
+)
+
+// DeadLetterStore 持久化失败的处理器调用，供重试和死信查看
+type DeadLetterStore struct {
+	db *gorm.DB
+}
+
+// NewDeadLetterStore 创建一个新的 DeadLetterStore
+func NewDeadLetterStore(dbPath string) (*DeadLetterStore, error) {
+	db, err := utils.OpenDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("open database error: %v", err)
+	}
+
+	if err := db.AutoMigrate(&types.DBDeadLetter{}); err != nil {
+		return nil, fmt.Errorf("auto migrate error: %v", err)
+	}
+
+	return &DeadLetterStore{db: db}, nil
+}
+
+// Close 关闭数据库连接
+func (s *DeadLetterStore) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Save 保存或更新一条记录
+func (s *DeadLetterStore) Save(d *types.DBDeadLetter) error {
+	return s.db.Save(d).Error
+}
+
+// Due 返回到期需要重试的记录
+func (s *DeadLetterStore) Due(now time.Time, limit int) ([]types.DBDeadLetter, error) {
+	var records []types.DBDeadLetter
+	err := s.db.Where("status = ? AND next_attempt_at <= ?", types.DeadLetterRetrying, now).
+		Order("next_attempt_at").
+		Limit(limit).
+		Find(&records).Error
+	return records, err
+}
+
+// Resolve 重试成功后删除记录
+func (s *DeadLetterStore) Resolve(d *types.DBDeadLetter) error {
+	return s.db.Unscoped().Delete(d).Error
+}
@@ -1,19 +1,149 @@
 package dispatcher
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
 )
 
+// ErrClosed is returned by Dispatch after the dispatcher has been closed
+var ErrClosed = errors.New("dispatcher is closed")
+
+// ErrHandlerNotFound is returned when no handler is registered under a name
+var ErrHandlerNotFound = errors.New("handler not found")
+
+// ErrQueueFull is returned by Dispatch when the queue is full and the policy is reject
+var ErrQueueFull = errors.New("dispatcher queue is full")
+
 // Dispatcher implements the types.Dispatcher interface
 type Dispatcher struct {
 	handlers    []types.Handler
-	handlersMap map[types.Handler]bool
+	handlersMap map[string]types.Handler // 处理器名称 -> 处理器
+	names       map[types.Handler]string // 处理器 -> 注册时确定的名称
+	disabled    map[string]bool          // 暂停的处理器名称
 	mu          sync.RWMutex
 	workers     chan struct{}
 	mailCh      chan *dispatchJob
-	done        chan struct{}
+	done        chan struct{} // 关闭后不再接收新邮件
+	stopped     chan struct{} // 队列排空、处理中的邮件完成后关闭
+	closeOnce   sync.Once
+	inflight    sync.WaitGroup
+
+	deadLetters *DeadLetterStore
+	retry       types.RetryConfig
+	processing  *ProcessingStore
+	mode        ExecutionMode
+
+	workerCount   int
+	queueSize     int
+	queueFull     QueueFullPolicy
+	spill         types.Dispatcher
+	handlerLimits map[string]chan struct{}
+
+	// ctx 在 Shutdown 超时或 Close 时取消，用于中断正在执行的处理器
+	ctx             context.Context
+	cancel          context.CancelFunc
+	handlerTimeout  time.Duration
+	handlerTimeouts map[string]time.Duration
+}
+
+// ExecutionMode controls what happens when a handler fails
+type ExecutionMode int
+
+const (
+	// StopOnError 第一个处理器失败后不再执行后续处理器（默认）
+	StopOnError ExecutionMode = iota
+	// ContinueOnError 执行全部匹配的处理器，汇总所有失败的错误
+	ContinueOnError
+)
+
+// QueueFullPolicy controls what Dispatch does when the queue is full
+type QueueFullPolicy string
+
+const (
+	// QueueFullBlock 等待队列有空位（默认）
+	QueueFullBlock QueueFullPolicy = "block"
+	// QueueFullReject 立即返回 ErrQueueFull，SMTP 源会回复 4xx
+	QueueFullReject QueueFullPolicy = "reject"
+	// QueueFullSpill 交给 SpillTo 设置的磁盘队列，未设置时等同于 block
+	QueueFullSpill QueueFullPolicy = "spill"
+)
+
+// ParseQueueFullPolicy 解析配置中的队列满策略，空字符串为 block
+func ParseQueueFullPolicy(s string) (QueueFullPolicy, error) {
+	switch p := QueueFullPolicy(s); p {
+	case "":
+		return QueueFullBlock, nil
+	case QueueFullBlock, QueueFullReject, QueueFullSpill:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown queue full policy %q, expected block, reject or spill", s)
+	}
+}
+
+// Option configures a Dispatcher
+type Option func(*Dispatcher)
+
+// WithWorkers 设置并发处理邮件的 worker 数量
+func WithWorkers(n int) Option {
+	return func(d *Dispatcher) {
+		if n > 0 {
+			d.workerCount = n
+		}
+	}
+}
+
+// WithQueueSize 设置等待处理的邮件队列长度
+func WithQueueSize(n int) Option {
+	return func(d *Dispatcher) {
+		if n >= 0 {
+			d.queueSize = n
+		}
+	}
+}
+
+// WithQueueFullPolicy 设置队列满时的处理策略
+func WithQueueFullPolicy(policy QueueFullPolicy) Option {
+	return func(d *Dispatcher) {
+		d.queueFull = policy
+	}
+}
+
+// WithHandlerTimeout 设置处理器的默认超时时间，0 表示不限制
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.handlerTimeout = timeout
+	}
+}
+
+// WithHandlerTimeoutFor 单独设置某个处理器的超时时间，覆盖默认值
+func WithHandlerTimeoutFor(name string, timeout time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.handlerTimeouts[name] = timeout
+	}
+}
+
+// WithHandlerConcurrency 限制某个处理器同时处理的邮件数量
+func WithHandlerConcurrency(name string, n int) Option {
+	return func(d *Dispatcher) {
+		if n > 0 {
+			d.handlerLimits[name] = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithExecutionMode 设置处理器失败时的执行模式
+func WithExecutionMode(mode ExecutionMode) Option {
+	return func(d *Dispatcher) {
+		d.mode = mode
+	}
 }
 
 type dispatchJob struct {
@@ -22,14 +152,27 @@ type dispatchJob struct {
 }
 
 // New creates a new Dispatcher
-func New() *Dispatcher {
+func New(opts ...Option) *Dispatcher {
 	d := &Dispatcher{
-		handlers:    make([]types.Handler, 0),
-		handlersMap: make(map[types.Handler]bool),
-		workers:     make(chan struct{}, 10),      // 最多10个并发worker
-		mailCh:      make(chan *dispatchJob, 100), // 邮件处理队列，缓冲100个
-		done:        make(chan struct{}),
+		handlers:      make([]types.Handler, 0),
+		handlersMap:   make(map[string]types.Handler),
+		names:         make(map[types.Handler]string),
+		disabled:      make(map[string]bool),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		workerCount:   10,  // 默认最多10个并发worker
+		queueSize:     100, // 默认邮件处理队列缓冲100个
+		queueFull:     QueueFullBlock,
+		handlerLimits: make(map[string]chan struct{}),
+
+		handlerTimeouts: make(map[string]time.Duration),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(d)
 	}
+	d.workers = make(chan struct{}, d.workerCount)
+	d.mailCh = make(chan *dispatchJob, d.queueSize)
 
 	// 启动worker pool
 	go d.run()
@@ -37,43 +180,155 @@ func New() *Dispatcher {
 	return d
 }
 
-// run 管理worker pool
+// run 管理worker pool，关闭后先排空队列、等待处理中的邮件完成再退出
 func (d *Dispatcher) run() {
+	defer close(d.stopped)
+
 	for {
 		select {
 		case <-d.done:
+			d.drain()
+			d.inflight.Wait()
 			return
 		case job := <-d.mailCh:
-			// 获取worker槽位
-			d.workers <- struct{}{}
-
-			// 启动goroutine处理邮件
-			go func(job *dispatchJob) {
-				defer func() {
-					<-d.workers // 释放worker槽位
-				}()
+			d.start(job)
+		}
+	}
+}
 
-				// 处理邮件
-				err := d.dispatchToHandlers(job.mail)
-				job.err <- err
-			}(job)
+// drain 处理关闭时队列中剩余的邮件，处理器被取消后剩余的邮件返回 ErrClosed
+func (d *Dispatcher) drain() {
+	for {
+		select {
+		case job := <-d.mailCh:
+			d.start(job)
+		default:
+			return
 		}
 	}
 }
 
+// start 获取worker槽位并启动goroutine处理邮件
+func (d *Dispatcher) start(job *dispatchJob) {
+	d.workers <- struct{}{}
+	if d.ctx.Err() != nil {
+		<-d.workers
+		job.err <- ErrClosed
+		return
+	}
+	d.inflight.Add(1)
+
+	go func() {
+		defer func() {
+			<-d.workers // 释放worker槽位
+			d.inflight.Done()
+		}()
+
+		// 处理邮件
+		job.err <- d.dispatchToHandlers(job.mail)
+	}()
+}
+
+// EnableRetry 开启处理器级别的重试，失败的调用记录到 store 中按指数退避重试，
+// 超过最大次数后标记为死信；其它处理器不受影响继续执行
+func (d *Dispatcher) EnableRetry(store *DeadLetterStore, config types.RetryConfig) {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 30 * time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = time.Hour
+	}
+
+	d.mu.Lock()
+	d.deadLetters = store
+	d.retry = config
+	d.mu.Unlock()
+
+	d.inflight.Add(1)
+	go d.retryLoop()
+}
+
+// RecordProcessing 开启处理记录，每次分发和重试都会为每个处理器保存匹配情况、耗时和结果
+func (d *Dispatcher) RecordProcessing(store *ProcessingStore) {
+	d.mu.Lock()
+	d.processing = store
+	d.mu.Unlock()
+}
+
 // AddHandler implements types.Dispatcher
+// 命名的处理器以名称区分，名称已被其它处理器使用时返回错误，不添加任何处理器；
+// 未命名的处理器以类型为名称，同类型的处理器依次加上 #2、#3 等序号
 func (d *Dispatcher) AddHandlers(handlers ...types.Handler) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	for _, h := range handlers {
-		if !d.handlersMap[h] {
-			d.handlers = append(d.handlers, h)
-			d.handlersMap[h] = true
+
+	names, err := d.assignNames(handlers, nil)
+	if err != nil {
+		return err
+	}
+
+	for i, h := range handlers {
+		if _, ok := d.names[h]; ok {
+			continue
 		}
+		d.handlers = append(d.handlers, h)
+		d.names[h] = names[i]
+		d.handlersMap[names[i]] = h
 	}
 	return nil
 }
 
+// assignNames 为 handlers 确定名称，已注册的处理器保留原来的名称，removed 中的处理器视为已删除。
+// 调用时需要持有写锁
+func (d *Dispatcher) assignNames(handlers []types.Handler, removed map[types.Handler]bool) ([]string, error) {
+	used := make(map[string]types.Handler, len(handlers))
+	for _, h := range handlers {
+		if h == nil {
+			return nil, errors.New("handler is nil")
+		}
+		if name, ok := d.names[h]; ok {
+			used[name] = h
+		}
+	}
+	owner := func(name string) types.Handler {
+		if h, ok := used[name]; ok {
+			return h
+		}
+		if h, ok := d.handlersMap[name]; ok && !removed[h] {
+			return h
+		}
+		return nil
+	}
+
+	names := make([]string, len(handlers))
+	for i, h := range handlers {
+		if name, ok := d.names[h]; ok {
+			names[i] = name
+			continue
+		}
+
+		name := types.HandlerName(h)
+		if n, ok := h.(types.NamedHandler); ok && n.Name() != "" {
+			if other := owner(name); other != nil && other != h {
+				if _, ok := used[name]; ok {
+					return nil, fmt.Errorf("handler %s is added twice", name)
+				}
+				return nil, fmt.Errorf("handler %s is already registered", name)
+			}
+		} else {
+			for n := 2; owner(name) != nil && owner(name) != h; n++ {
+				name = fmt.Sprintf("%s#%d", types.HandlerName(h), n)
+			}
+		}
+		names[i] = name
+		used[name] = h
+	}
+	return names, nil
+}
+
 // RemoveHandler implements types.Dispatcher
 func (d *Dispatcher) RemoveHandlers(handlers ...types.Handler) error {
 	d.mu.Lock()
@@ -81,8 +336,11 @@ func (d *Dispatcher) RemoveHandlers(handlers ...types.Handler) error {
 	for _, h := range handlers {
 		for i, handler := range d.handlers {
 			if handler == h {
+				name := d.names[h]
 				d.handlers = append(d.handlers[:i], d.handlers[i+1:]...)
-				delete(d.handlersMap, h)
+				delete(d.handlersMap, name)
+				delete(d.names, h)
+				delete(d.disabled, name)
 				break
 			}
 		}
@@ -90,8 +348,136 @@ func (d *Dispatcher) RemoveHandlers(handlers ...types.Handler) error {
 	return nil
 }
 
-// Dispatch implements types.Dispatcher
+// ReplaceHandlers 原子地用 handlers 替换 old，正在分发的邮件使用替换前或替换后的完整处理器列表。
+// 新处理器放在 old 中第一个已注册处理器的位置，old 都未注册时放在最前面；
+// 名称不变的处理器保留暂停状态
+func (d *Dispatcher) ReplaceHandlers(old, handlers []types.Handler) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	removed := make(map[types.Handler]bool, len(old))
+	for _, h := range old {
+		removed[h] = true
+	}
+
+	names, err := d.assignNames(handlers, removed)
+	if err != nil {
+		return err
+	}
+	added := make(map[types.Handler]string, len(handlers))
+	for i, h := range handlers {
+		added[h] = names[i]
+	}
+
+	pos := -1
+	list := make([]types.Handler, 0, len(d.handlers)+len(handlers))
+	for _, h := range d.handlers {
+		if removed[h] {
+			if pos < 0 {
+				pos = len(list)
+			}
+			continue
+		}
+		if _, ok := added[h]; ok {
+			continue // 已注册的处理器移到新的位置
+		}
+		list = append(list, h)
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	var insert []types.Handler
+	for _, h := range handlers {
+		if _, ok := added[h]; ok {
+			insert = append(insert, h)
+			delete(added, h)
+		}
+	}
+	list = append(list[:pos], append(insert, list[pos:]...)...)
+
+	for i, h := range handlers {
+		added[h] = names[i]
+	}
+	oldNames := d.names
+	d.handlers = list
+	d.names = make(map[types.Handler]string, len(list))
+	d.handlersMap = make(map[string]types.Handler, len(list))
+	for _, h := range list {
+		name, ok := added[h]
+		if !ok {
+			name = oldNames[h]
+		}
+		d.names[h] = name
+		d.handlersMap[name] = h
+	}
+	for name := range d.disabled {
+		if _, ok := d.handlersMap[name]; !ok {
+			delete(d.disabled, name)
+		}
+	}
+	return nil
+}
+
+// Handlers 按注册顺序返回所有处理器及其启用状态
+func (d *Dispatcher) Handlers() []types.HandlerInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	infos := make([]types.HandlerInfo, 0, len(d.handlers))
+	for _, h := range d.handlers {
+		name := d.names[h]
+		infos = append(infos, types.HandlerInfo{
+			Name:    name,
+			Type:    fmt.Sprintf("%T", h),
+			Enabled: !d.disabled[name],
+		})
+	}
+	return infos
+}
+
+// EnableHandler 恢复暂停的处理器
+func (d *Dispatcher) EnableHandler(name string) error {
+	return d.setEnabled(name, true)
+}
+
+// DisableHandler 暂停处理器，暂停期间新邮件不再交给它处理，等待重试的调用推迟到恢复之后
+func (d *Dispatcher) DisableHandler(name string) error {
+	return d.setEnabled(name, false)
+}
+
+// setEnabled 修改处理器的启用状态
+func (d *Dispatcher) setEnabled(name string, enabled bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.handlersMap[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrHandlerNotFound, name)
+	}
+	if enabled {
+		delete(d.disabled, name)
+		log.Printf("dispatcher: handler %s enabled", name)
+	} else {
+		d.disabled[name] = true
+		log.Printf("dispatcher: handler %s disabled", name)
+	}
+	return nil
+}
+
+// isDisabled 处理器是否已暂停
+func (d *Dispatcher) isDisabled(name string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.disabled[name]
+}
+
+// Dispatch implements types.Dispatcher，关闭后返回 ErrClosed
 func (d *Dispatcher) Dispatch(mail *types.Mail) error {
+	select {
+	case <-d.done:
+		return ErrClosed
+	default:
+	}
+
 	// 创建新的任务
 	job := &dispatchJob{
 		mail: mail,
@@ -102,31 +488,364 @@ func (d *Dispatcher) Dispatch(mail *types.Mail) error {
 	select {
 	case d.mailCh <- job:
 		// 等待处理完成
-		return <-job.err
+		return d.wait(job)
 	case <-d.done:
-		return nil
+		return ErrClosed
+	default:
+	}
+
+	// 队列已满
+	switch d.queueFull {
+	case QueueFullReject:
+		return ErrQueueFull
+	case QueueFullSpill:
+		d.mu.RLock()
+		spill := d.spill
+		d.mu.RUnlock()
+		if spill != nil {
+			return spill.Dispatch(mail)
+		}
+	}
+
+	select {
+	case d.mailCh <- job:
+		return d.wait(job)
+	case <-d.done:
+		return ErrClosed
 	}
 }
 
+// wait 等待任务处理完成，dispatcher 停止时仍未处理的任务返回 ErrClosed
+func (d *Dispatcher) wait(job *dispatchJob) error {
+	select {
+	case err := <-job.err:
+		return err
+	case <-d.stopped:
+		select {
+		case err := <-job.err:
+			return err
+		default:
+			return ErrClosed
+		}
+	}
+}
+
+// SpillTo 设置队列满时接收邮件的磁盘队列，配合 QueueFullSpill 使用
+func (d *Dispatcher) SpillTo(spill types.Dispatcher) {
+	d.mu.Lock()
+	d.spill = spill
+	d.mu.Unlock()
+}
+
 // dispatchToHandlers 将邮件分发给匹配的处理器
 func (d *Dispatcher) dispatchToHandlers(mail *types.Mail) error {
 	d.mu.RLock()
 	handlers := make([]types.Handler, len(d.handlers))
 	copy(handlers, d.handlers)
+	names := make([]string, len(handlers))
+	for i, h := range handlers {
+		names[i] = d.names[h]
+	}
+	disabled := make(map[string]bool, len(d.disabled))
+	for name := range d.disabled {
+		disabled[name] = true
+	}
+	deadLetters, retry, mode := d.deadLetters, d.retry, d.mode
 	d.mu.RUnlock()
 
-	for _, handler := range handlers {
-		if handler.Match(mail) {
-			if err := handler.Handle(mail); err != nil {
-				return err
+	var records []*types.DBProcessing
+	defer func() { d.saveProcessing(records) }()
+
+	var errs types.HandlerErrors
+	for i, handler := range handlers {
+		name := names[i]
+		if disabled[name] {
+			records = append(records, &types.DBProcessing{
+				MailID:  mail.ID,
+				Source:  mail.Source,
+				Handler: name,
+				Attempt: 1,
+				Outcome: types.ProcessingDisabled,
+			})
+			continue
+		}
+
+		start := time.Now()
+		matched, err := utils.SafeMatch(handler, mail)
+		if err == nil && matched {
+			err = d.handle(handler, name, mail)
+		}
+		records = append(records, newProcessing(mail, name, 1, matched, time.Since(start), err))
+		if errors.Is(err, types.ErrDrop) {
+			break
+		}
+		if err == nil {
+			continue
+		}
+
+		if deadLetters != nil {
+			// 记录失败等待重试，继续执行其它处理器
+			if err = recordFailure(deadLetters, retry, mail, name, err); err == nil {
+				continue
 			}
 		}
+
+		herr := &types.HandlerError{Handler: name, Err: err}
+		if mode == StopOnError {
+			return herr
+		}
+		errs = append(errs, herr)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// handle 调用处理器，遵守处理器的并发限制和超时时间，Close 时取消
+func (d *Dispatcher) handle(handler types.Handler, name string, mail *types.Mail) error {
+	ctx := d.ctx
+	timeout, ok := d.handlerTimeouts[name]
+	if !ok {
+		timeout = d.handlerTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if limit, ok := d.handlerLimits[name]; ok {
+		select {
+		case limit <- struct{}{}:
+			defer func() { <-limit }()
+		case <-ctx.Done():
+			return fmt.Errorf("handler %s: %w", name, ctx.Err())
+		}
+	}
+	return utils.SafeHandleContext(ctx, handler, mail)
+}
+
+// newProcessing 创建一条处理记录
+func newProcessing(mail *types.Mail, handler string, attempt int, matched bool, duration time.Duration, err error) *types.DBProcessing {
+	return &types.DBProcessing{
+		MailID:   mail.ID,
+		Source:   mail.Source,
+		Handler:  handler,
+		Attempt:  attempt,
+		Matched:  matched,
+		Duration: duration,
+		Outcome:  processingOutcome(matched, err),
+		Error:    errorString(err),
+	}
+}
+
+// processingOutcome 根据匹配情况和错误得到处理结果，Match panic 也视为失败
+func processingOutcome(matched bool, err error) string {
+	switch {
+	case errors.Is(err, types.ErrDrop):
+		return types.ProcessingDropped
+	case err != nil:
+		return types.ProcessingFailed
+	case !matched:
+		return types.ProcessingSkipped
+	default:
+		return types.ProcessingSuccess
+	}
+}
+
+func errorString(err error) string {
+	if err == nil || errors.Is(err, types.ErrDrop) {
+		return ""
+	}
+	return err.Error()
+}
+
+// saveProcessing 保存处理记录，保存失败只记录日志，不影响邮件处理结果
+func (d *Dispatcher) saveProcessing(records []*types.DBProcessing) {
+	d.mu.RLock()
+	store := d.processing
+	d.mu.RUnlock()
+	if store == nil || len(records) == 0 {
+		return
+	}
+	if err := store.Save(records); err != nil {
+		log.Printf("dispatcher: save processing records for mail %s error: %v", records[0].MailID, err)
+	}
+}
+
+// recordFailure 在 store 中记录一次失败的处理器调用
+func recordFailure(store *DeadLetterStore, retry types.RetryConfig, mail *types.Mail, handler string, handleErr error) error {
+	env, err := json.Marshal(mail.Envelope)
+	if err != nil {
+		return err
+	}
+
+	record := &types.DBDeadLetter{
+		MailID:    mail.ID,
+		Subject:   mail.Subject,
+		Source:    mail.Source,
+		Envelope:  string(env),
+		Handler:   handler,
+		Raw:       mail.Raw,
+		Attempts:  1,
+		LastError: handleErr.Error(),
+	}
+	scheduleRetry(retry, record, handleErr)
+	log.Printf("dispatcher: handler %s failed for mail %s (%s): %v", record.Handler, record.MailID, record.Status, handleErr)
+
+	if err := store.Save(record); err != nil {
+		return fmt.Errorf("record handler failure error: %v (handler error: %v)", err, handleErr)
 	}
 	return nil
 }
 
-// Close 关闭dispatcher
+// scheduleRetry 根据失败次数设置下一次重试时间，或标记为死信
+func scheduleRetry(retry types.RetryConfig, record *types.DBDeadLetter, handleErr error) {
+	// 没有原文的邮件无法重试
+	if types.IsPermanent(handleErr) || len(record.Raw) == 0 || record.Attempts >= retry.MaxAttempts {
+		record.Status = types.DeadLetterDead
+		return
+	}
+
+	backoff := retry.Backoff
+	for i := 1; i < record.Attempts && backoff < retry.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > retry.MaxBackoff {
+		backoff = retry.MaxBackoff
+	}
+	record.Status = types.DeadLetterRetrying
+	record.NextAttemptAt = time.Now().Add(backoff)
+}
+
+// retryLoop 定期重试到期的失败调用
+func (d *Dispatcher) retryLoop() {
+	defer d.inflight.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			records, err := d.deadLetters.Due(time.Now(), 50)
+			if err != nil {
+				log.Printf("dispatcher: load retries error: %v", err)
+				continue
+			}
+			for i := range records {
+				if d.closing() {
+					return
+				}
+				d.retryOne(&records[i])
+			}
+		}
+	}
+}
+
+// retryOne 重试一次失败的调用
+func (d *Dispatcher) retryOne(record *types.DBDeadLetter) {
+	// 处理器暂停期间不计入重试次数，推迟到恢复之后
+	if d.isDisabled(record.Handler) {
+		record.NextAttemptAt = time.Now().Add(d.retry.Backoff)
+		if err := d.deadLetters.Save(record); err != nil {
+			log.Printf("dispatcher: update dead letter %d error: %v", record.ID, err)
+		}
+		return
+	}
+
+	start := time.Now()
+	err := d.handleAgain(record)
+	d.saveProcessing([]*types.DBProcessing{{
+		MailID:   record.MailID,
+		Source:   record.Source,
+		Handler:  record.Handler,
+		Attempt:  record.Attempts + 1,
+		Matched:  true,
+		Duration: time.Since(start),
+		Outcome:  processingOutcome(true, err),
+		Error:    errorString(err),
+	}})
+	if err == nil || errors.Is(err, types.ErrDrop) {
+		log.Printf("dispatcher: retry of handler %s for mail %s succeeded", record.Handler, record.MailID)
+		if err := d.deadLetters.Resolve(record); err != nil {
+			log.Printf("dispatcher: resolve dead letter %d error: %v", record.ID, err)
+		}
+		return
+	}
+
+	record.Attempts++
+	record.LastError = err.Error()
+	scheduleRetry(d.retry, record, err)
+	log.Printf("dispatcher: retry %d of handler %s for mail %s failed (%s): %v", record.Attempts, record.Handler, record.MailID, record.Status, err)
+	if err := d.deadLetters.Save(record); err != nil {
+		log.Printf("dispatcher: update dead letter %d error: %v", record.ID, err)
+	}
+}
+
+// handleAgain 还原邮件并重新调用对应的处理器
+func (d *Dispatcher) handleAgain(record *types.DBDeadLetter) error {
+	handler := d.Handler(record.Handler)
+	if handler == nil {
+		return types.Permanent(fmt.Errorf("handler %s is not registered", record.Handler))
+	}
+
+	var env types.Envelope
+	if record.Envelope != "" {
+		if err := json.Unmarshal([]byte(record.Envelope), &env); err != nil {
+			return types.Permanent(fmt.Errorf("decode envelope error: %v", err))
+		}
+	}
+	mail, err := utils.RestoreMail(record.Raw, record.MailID, record.Source, env)
+	if err != nil {
+		return types.Permanent(fmt.Errorf("parse mail error: %v", err))
+	}
+
+	return d.handle(handler, record.Handler, mail)
+}
+
+// Handler 根据名称查找处理器，未注册时返回 nil
+func (d *Dispatcher) Handler(name string) types.Handler {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.handlersMap[name]
+}
+
+// closing 是否已经开始关闭
+func (d *Dispatcher) closing() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown 停止接收新邮件，等待队列中和处理中的邮件处理完成。
+// ctx 到期后取消正在执行的处理器，队列中剩余的邮件返回 ErrClosed，并返回 ctx.Err()
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.closeOnce.Do(func() { close(d.done) })
+
+	select {
+	case <-d.stopped:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	d.cancel()
+	<-d.stopped
+	return ctx.Err()
+}
+
+// Close 立即关闭dispatcher，取消正在执行的处理器，需要等待处理完成时使用 Shutdown
 func (d *Dispatcher) Close() error {
-	close(d.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Shutdown(ctx)
 	return nil
 }
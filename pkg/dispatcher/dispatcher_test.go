@@ -0,0 +1,245 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// testHandler 是可命名的测试处理器，handle 为空时处理成功
+type testHandler struct {
+	name   string
+	handle func(mail *types.Mail) error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (h *testHandler) Name() string                { return h.name }
+func (h *testHandler) Match(mail *types.Mail) bool { return true }
+
+func (h *testHandler) Handle(mail *types.Mail) error {
+	h.mu.Lock()
+	h.calls++
+	h.mu.Unlock()
+	if h.handle != nil {
+		return h.handle(mail)
+	}
+	return nil
+}
+
+func (h *testHandler) called() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+// anonHandler 没有名称，以类型区分
+type anonHandler struct{ id int }
+
+func (h *anonHandler) Match(mail *types.Mail) bool   { return true }
+func (h *anonHandler) Handle(mail *types.Mail) error { return nil }
+
+func newTestMail(id string) *types.Mail {
+	return &types.Mail{
+		ID:     id,
+		Source: "test",
+		Raw:    []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: " + id + "\r\n\r\nhello\r\n"),
+	}
+}
+
+// waitFor 等待 cond 成立，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExecutionMode(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name      string
+		mode      ExecutionMode
+		wantCalls int
+	}{
+		{"stop on error", StopOnError, 0},
+		{"continue on error", ContinueOnError, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing := &testHandler{name: "failing", handle: func(*types.Mail) error { return errFailed }}
+			next := &testHandler{name: "next"}
+			d := New(WithExecutionMode(tt.mode))
+			defer d.Close()
+			if err := d.AddHandlers(failing, next); err != nil {
+				t.Fatal(err)
+			}
+
+			// StopOnError 返回第一个失败，ContinueOnError 汇总所有失败
+			err := d.Dispatch(newTestMail("mail-1"))
+			var herr *types.HandlerError
+			var multi types.HandlerErrors
+			if errors.As(err, &multi) && len(multi) == 1 {
+				herr = multi[0]
+			} else if !errors.As(err, &herr) {
+				t.Fatalf("Dispatch error = %v, want a handler error", err)
+			}
+			if herr.Handler != "failing" || !errors.Is(herr, errFailed) {
+				t.Errorf("handler error = %v, want failing: %v", herr, errFailed)
+			}
+			if got := next.called(); got != tt.wantCalls {
+				t.Errorf("next handler called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryResolvesDeadLetter(t *testing.T) {
+	store, err := NewDeadLetterStore(filepath.Join(t.TempDir(), "emails.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	failing := &testHandler{name: "flaky"}
+	failing.handle = func(*types.Mail) error {
+		if failing.called() == 1 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}
+	other := &testHandler{name: "other"}
+
+	d := New()
+	defer d.Close()
+	d.EnableRetry(store, types.RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond})
+	if err := d.AddHandlers(failing, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// 失败记入死信等待重试，不影响其它处理器和 Dispatch 的结果
+	if err := d.Dispatch(newTestMail("mail-1")); err != nil {
+		t.Fatalf("Dispatch error = %v, want nil", err)
+	}
+	if got := other.called(); got != 1 {
+		t.Errorf("other handler called %d times, want 1", got)
+	}
+	records, err := store.Due(time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Handler != "flaky" || records[0].MailID != "mail-1" || records[0].Status != types.DeadLetterRetrying {
+		t.Fatalf("dead letters = %+v, want one retrying record for flaky", records)
+	}
+
+	waitFor(t, "retry", func() bool { return failing.called() == 2 })
+	waitFor(t, "resolve", func() bool {
+		records, err := store.Due(time.Now().Add(time.Hour), 10)
+		return err == nil && len(records) == 0
+	})
+	if got := other.called(); got != 1 {
+		t.Errorf("other handler called %d times after retry, want 1", got)
+	}
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	h := &testHandler{name: "slow", handle: func(*types.Mail) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}}
+	d := New(WithWorkers(1), WithQueueSize(10))
+	if err := d.AddHandlers(h); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 3)
+	for _, id := range []string{"mail-1", "mail-2", "mail-3"} {
+		go func(id string) { results <- d.Dispatch(newTestMail(id)) }(id)
+	}
+	// 一封在处理，一封等待 worker，一封在队列中
+	<-started
+	waitFor(t, "queued mail", func() bool { return len(d.mailCh) == 1 })
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- d.Shutdown(context.Background()) }()
+	waitFor(t, "shutdown", d.closing)
+	if err := d.Dispatch(newTestMail("mail-4")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Dispatch after shutdown error = %v, want ErrClosed", err)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Dispatch error = %v, want nil", err)
+		}
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Shutdown error = %v", err)
+	}
+	if got := h.called(); got != 3 {
+		t.Errorf("handler called %d times, want 3", got)
+	}
+}
+
+func TestHandlerNames(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	a, b, c := &anonHandler{1}, &anonHandler{2}, &anonHandler{3}
+	if err := d.AddHandlers(a, b, c); err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, d, "*dispatcher.anonHandler", "*dispatcher.anonHandler#2", "*dispatcher.anonHandler#3")
+
+	// 替换后的处理器沿用空出来的序号和位置
+	e := &anonHandler{4}
+	if err := d.ReplaceHandlers([]types.Handler{b}, []types.Handler{e}); err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, d, "*dispatcher.anonHandler", "*dispatcher.anonHandler#2", "*dispatcher.anonHandler#3")
+	if d.Handler("*dispatcher.anonHandler#2") != e {
+		t.Errorf("#2 is not the replacement handler")
+	}
+
+	// 命名的处理器不加序号，重名时报错且不添加任何处理器
+	if err := d.AddHandlers(&testHandler{name: "rule"}, &testHandler{name: "rule"}); err == nil {
+		t.Error("AddHandlers with a duplicate name succeeded")
+	}
+	if err := d.AddHandlers(&testHandler{name: "rule"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddHandlers(&testHandler{name: "rule"}); err == nil {
+		t.Error("AddHandlers with a registered name succeeded")
+	}
+	assertNames(t, d, "*dispatcher.anonHandler", "*dispatcher.anonHandler#2", "*dispatcher.anonHandler#3", "rule")
+}
+
+func assertNames(t *testing.T, d *Dispatcher, want ...string) {
+	t.Helper()
+	infos := d.Handlers()
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Name)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("handlers = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("handlers = %v, want %v", got, want)
+		}
+	}
+}
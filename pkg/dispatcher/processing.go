@@ -0,0 +1,46 @@
+package dispatcher
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
+)
+
+// ProcessingStore 持久化每封邮件在各个处理器上的处理结果
+type ProcessingStore struct {
+	db *gorm.DB
+}
+
+// NewProcessingStore 创建一个新的 ProcessingStore
+func NewProcessingStore(dbPath string) (*ProcessingStore, error) {
+	db, err := utils.OpenDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("open database error: %v", err)
+	}
+
+	if err := db.AutoMigrate(&types.DBProcessing{}); err != nil {
+		return nil, fmt.Errorf("auto migrate error: %v", err)
+	}
+
+	return &ProcessingStore{db: db}, nil
+}
+
+// Close 关闭数据库连接
+func (s *ProcessingStore) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Save 批量写入处理记录
+func (s *ProcessingStore) Save(records []*types.DBProcessing) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return s.db.Create(&records).Error
+}
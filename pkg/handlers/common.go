@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
+	"net/smtp"
 	"os"
 	"path/filepath"
 
 	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
 )
 
 // LogHandler 是一个简单的日志处理器
@@ -33,6 +38,11 @@ func (h *LogHandler) Handle(mail *types.Mail) error {
 	return nil
 }
 
+// Name 返回处理器名称
+func (h *LogHandler) Name() string {
+	return "log"
+}
+
 // Match 实现 Handler 接口
 func (h *LogHandler) Match(mail *types.Mail) bool {
 	return true
@@ -64,28 +74,118 @@ func (h *SaveAttachmentHandler) Handle(mail *types.Mail) error {
 	return nil
 }
 
+// Name 返回处理器名称
+func (h *SaveAttachmentHandler) Name() string {
+	return "save_attachment"
+}
+
 // Match 实现 Handler 接口
 func (h *SaveAttachmentHandler) Match(mail *types.Mail) bool {
 	return len(mail.Attachments) > 0
 }
 
-// ForwardHandler 是一个转发邮件的处理器
+// ForwardHandler 是一个通过 SMTP 服务器转发原始邮件的处理器
 type ForwardHandler struct {
-	forwardTo []string
-	// TODO: 实现邮件转发功能
+	config ForwardConfig
+}
+
+// ForwardConfig 配置 ForwardHandler
+type ForwardConfig struct {
+	// SMTP 服务器地址，host:port
+	Server string
+	// MAIL FROM，为空时使用原邮件的信封发件人或 From
+	From string
+	// 转发的收件人
+	To []string
+	// SMTP AUTH 账号，为空时不认证
+	Username string
+	Password string
 }
 
 // NewForwardHandler 创建一个新的转发处理器
-func NewForwardHandler(forwardTo []string) *ForwardHandler {
-	return &ForwardHandler{
-		forwardTo: forwardTo,
+func NewForwardHandler(config ForwardConfig) (*ForwardHandler, error) {
+	if config.Server == "" {
+		return nil, fmt.Errorf("forward server is required")
+	}
+	if len(config.To) == 0 {
+		return nil, fmt.Errorf("forward recipients are required")
 	}
+	return &ForwardHandler{
+		config: config,
+	}, nil
 }
 
 // Handle 实现 Handler 接口
 func (h *ForwardHandler) Handle(mail *types.Mail) error {
-	// TODO: 实现邮件转发逻辑
-	return nil
+	return h.HandleContext(context.Background(), mail)
+}
+
+// HandleContext 实现 ContextHandler 接口
+func (h *ForwardHandler) HandleContext(ctx context.Context, mail *types.Mail) error {
+	if len(mail.Raw) == 0 {
+		return types.Permanent(fmt.Errorf("raw mail is not available"))
+	}
+
+	from := h.config.From
+	if from == "" {
+		from = mail.Envelope.From
+	}
+	if from == "" && len(mail.From) > 0 {
+		from = mail.From[0].Address
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", h.config.Server)
+	if err != nil {
+		return fmt.Errorf("dial %s error: %v", h.config.Server, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(h.config.Server)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("smtp handshake error: %v", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("starttls error: %v", err)
+		}
+	}
+	if h.config.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", h.config.Username, h.config.Password, host)); err != nil {
+			return fmt.Errorf("smtp auth error: %v", err)
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("mail from error: %v", err)
+	}
+	for _, to := range h.config.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("rcpt to %s error: %v", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("data error: %v", err)
+	}
+	if _, err := w.Write(mail.Raw); err != nil {
+		return fmt.Errorf("write mail error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("send mail error: %v", err)
+	}
+	return c.Quit()
+}
+
+// Name 返回处理器名称
+func (h *ForwardHandler) Name() string {
+	return "forward"
 }
 
 // Match 实现 Handler 接口
@@ -95,7 +195,8 @@ func (h *ForwardHandler) Match(mail *types.Mail) bool {
 
 // ChainHandler 是一个处理器链，可以按顺序执行多个处理器
 type ChainHandler struct {
-	handlers []types.Handler
+	handlers        []types.Handler
+	continueOnError bool
 }
 
 // NewChainHandler 创建一个新的处理器链
@@ -107,26 +208,51 @@ func NewChainHandler(handlers ...types.Handler) *ChainHandler {
 
 // Handle 实现 Handler 接口
 func (h *ChainHandler) Handle(mail *types.Mail) error {
+	var errs types.HandlerErrors
 	for _, handler := range h.handlers {
-		if handler.Match(mail) {
-			if err := handler.Handle(mail); err != nil {
-				return err
-			}
+		matched, err := utils.SafeMatch(handler, mail)
+		if err == nil && matched {
+			err = utils.SafeHandle(handler, mail)
+		}
+		if err == nil {
+			continue
+		}
+
+		herr := &types.HandlerError{Handler: types.HandlerName(handler), Err: err}
+		if !h.continueOnError {
+			return herr
 		}
+		errs = append(errs, herr)
+	}
+
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
+// Name 返回处理器名称
+func (h *ChainHandler) Name() string {
+	return "chain"
+}
+
 // Match 实现 Handler 接口
 func (h *ChainHandler) Match(mail *types.Mail) bool {
 	for _, handler := range h.handlers {
-		if handler.Match(mail) {
+		// Match 发生 panic 时交给 Handle 报告错误
+		if matched, err := utils.SafeMatch(handler, mail); matched || err != nil {
 			return true
 		}
 	}
 	return false
 }
 
+// ContinueOnError 设置链中某个处理器失败后继续执行后续处理器，并汇总所有错误
+func (h *ChainHandler) ContinueOnError() *ChainHandler {
+	h.continueOnError = true
+	return h
+}
+
 // Add 添加一个新的处理器到链中
 func (h *ChainHandler) Add(handler types.Handler) *ChainHandler {
 	h.handlers = append(h.handlers, handler)
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// ExecHandler 执行外部命令处理邮件，原始邮件写入命令的 stdin
+// 命令的环境变量中包含 LISTENMAIL_ID、LISTENMAIL_SOURCE、LISTENMAIL_SUBJECT 和 LISTENMAIL_FROM
+type ExecHandler struct {
+	command []string
+}
+
+// NewExecHandler 创建一个新的 ExecHandler，command 为程序及其参数
+func NewExecHandler(command []string) (*ExecHandler, error) {
+	if len(command) == 0 || command[0] == "" {
+		return nil, fmt.Errorf("exec command is required")
+	}
+	return &ExecHandler{
+		command: command,
+	}, nil
+}
+
+// Handle 实现 Handler 接口
+func (h *ExecHandler) Handle(mail *types.Mail) error {
+	return h.HandleContext(context.Background(), mail)
+}
+
+// HandleContext 实现 ContextHandler 接口，命令退出码非 0 时返回错误
+func (h *ExecHandler) HandleContext(ctx context.Context, mail *types.Mail) error {
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Stdin = bytes.NewReader(mail.Raw)
+
+	var from string
+	if len(mail.From) > 0 {
+		from = mail.From[0].Address
+	}
+	cmd.Env = append(os.Environ(),
+		"LISTENMAIL_ID="+mail.ID,
+		"LISTENMAIL_SOURCE="+mail.Source,
+		"LISTENMAIL_SUBJECT="+mail.Subject,
+		"LISTENMAIL_FROM="+from,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		out := strings.TrimSpace(string(output))
+		if len(out) > 512 {
+			out = out[:512]
+		}
+		return fmt.Errorf("exec %s error: %v: %s", h.command[0], err, out)
+	}
+	return nil
+}
+
+// Name 返回处理器名称
+func (h *ExecHandler) Name() string {
+	return "exec"
+}
+
+// Match 实现 Handler 接口
+func (h *ExecHandler) Match(mail *types.Mail) bool {
+	return true
+}
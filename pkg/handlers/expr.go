@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// ExprMail 是表达式中可以使用的邮件字段，字段名为 expr 标签中的名称，例如：
+//
+//	any(from, .address endsWith "@github.com") && size < 1e6 && lower(subject) contains "urgent"
+//	len(attachments) > 2 || headers["x-priority"][0] == "1"
+type ExprMail struct {
+	ID          string              `expr:"id"`
+	Source      string              `expr:"source"`
+	MessageID   string              `expr:"message_id"`
+	Subject     string              `expr:"subject"`
+	Date        time.Time           `expr:"date"`
+	From        []ExprAddress       `expr:"from"`
+	To          []ExprAddress       `expr:"to"`
+	Cc          []ExprAddress       `expr:"cc"`
+	Bcc         []ExprAddress       `expr:"bcc"`
+	ReplyTo     []ExprAddress       `expr:"reply_to"`
+	Text        string              `expr:"text"`
+	HTML        string              `expr:"html"`
+	Attachments []ExprAttachment    `expr:"attachments"`
+	Headers     map[string][]string `expr:"headers"` // 头部名称为小写，包含原始邮件中的所有头部
+	Size        int                 `expr:"size"`    // 原始邮件字节数
+	Tags        []string            `expr:"tags"`
+	Envelope    ExprEnvelope        `expr:"envelope"`
+}
+
+// ExprAddress 是表达式中的邮件地址
+type ExprAddress struct {
+	Name    string `expr:"name"`
+	Address string `expr:"address"`
+}
+
+// ExprAttachment 是表达式中的附件
+type ExprAttachment struct {
+	Filename    string `expr:"filename"`
+	ContentType string `expr:"content_type"`
+	Size        int    `expr:"size"`
+}
+
+// ExprEnvelope 是表达式中的信封
+type ExprEnvelope struct {
+	From       string   `expr:"from"`
+	To         []string `expr:"to"`
+	RemoteAddr string   `expr:"remote_addr"`
+	Helo       string   `expr:"helo"`
+	TLS        bool     `expr:"tls"`
+	Folder     string   `expr:"folder"`
+}
+
+// Expr 编译表达式条件，表达式必须返回 bool，字段名或类型错误时返回带位置的错误
+// 表达式语法见 https://expr-lang.org/docs/language-definition
+func Expr(expression string) (Condition, error) {
+	program, err := expr.Compile(expression, expr.Env(ExprMail{}), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("compile expression error: %v", err)
+	}
+	return exprCondition(expression, program), nil
+}
+
+// exprCondition 执行编译好的表达式，运行时出错（如下标越界）时记录日志并视为不匹配
+func exprCondition(expression string, program *vm.Program) Condition {
+	return func(m *types.Mail) bool {
+		out, err := expr.Run(program, NewExprMail(m))
+		if err != nil {
+			log.Printf("expression %q error for mail %s: %v", expression, m.ID, err)
+			return false
+		}
+		matched, _ := out.(bool)
+		return matched
+	}
+}
+
+// NewExprMail 将邮件转换为表达式使用的结构
+func NewExprMail(m *types.Mail) ExprMail {
+	em := ExprMail{
+		ID:        m.ID,
+		Source:    m.Source,
+		MessageID: m.MessageID,
+		Subject:   m.Subject,
+		Date:      m.Date,
+		From:      exprAddresses(m.From),
+		To:        exprAddresses(m.To),
+		Cc:        exprAddresses(m.Cc),
+		Bcc:       exprAddresses(m.Bcc),
+		ReplyTo:   exprAddresses(m.ReplyTo),
+		Text:      m.Text,
+		HTML:      m.HTML,
+		Headers:   exprHeaders(m),
+		Size:      len(m.Raw),
+		Tags:      append([]string{}, m.Tags...),
+		Envelope: ExprEnvelope{
+			From:       m.Envelope.From,
+			To:         append([]string{}, m.Envelope.To...),
+			RemoteAddr: m.Envelope.RemoteAddr,
+			Helo:       m.Envelope.Helo,
+			TLS:        m.Envelope.TLS,
+			Folder:     m.Envelope.Folder,
+		},
+	}
+	em.Attachments = make([]ExprAttachment, 0, len(m.Attachments))
+	for _, att := range m.Attachments {
+		em.Attachments = append(em.Attachments, ExprAttachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			Size:        len(att.Data),
+		})
+	}
+	return em
+}
+
+func exprAddresses(addrs []*mail.Address) []ExprAddress {
+	result := make([]ExprAddress, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr != nil {
+			result = append(result, ExprAddress{Name: addr.Name, Address: addr.Address})
+		}
+	}
+	return result
+}
+
+// exprHeaders 返回所有头部，优先从原始邮件读取，名称转换为小写
+func exprHeaders(m *types.Mail) map[string][]string {
+	headers := make(map[string][]string)
+	for name, values := range m.Headers {
+		headers[strings.ToLower(name)] = values
+	}
+	if len(m.Raw) > 0 {
+		raw, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(m.Raw))).ReadMIMEHeader()
+		for name, values := range raw {
+			headers[strings.ToLower(name)] = values
+		}
+	}
+	return headers
+}
@@ -1,6 +1,10 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/textproto"
 	"regexp"
 	"time"
 
@@ -12,10 +16,17 @@ type Condition func(*types.Mail) bool
 
 // Handler 是一个基于条件的邮件处理器
 type Handler struct {
+	name      string
 	handle    func(*types.Mail) error
 	condition Condition
 }
 
+// ContextHandler 是一个支持超时和取消的、基于条件的邮件处理器
+type ContextHandler struct {
+	*Handler
+	handleContext func(context.Context, *types.Mail) error
+}
+
 func WrapHandlers(handles ...func(*types.Mail) error) func(*types.Mail) error {
 	return func(m *types.Mail) error {
 		for _, h := range handles {
@@ -39,11 +50,38 @@ func NewHandler(handle func(*types.Mail) error, condition Condition) *Handler {
 	}
 }
 
+// NewNamedHandler 创建一个带名称的处理器，名称用于重试和死信记录
+func NewNamedHandler(name string, handle func(*types.Mail) error, condition Condition) *Handler {
+	h := NewHandler(handle, condition)
+	h.name = name
+	return h
+}
+
+// NewContextHandler 创建一个支持超时和取消的处理器，dispatcher 会传入带超时的 ctx
+func NewContextHandler(name string, handle func(context.Context, *types.Mail) error, condition Condition) *ContextHandler {
+	return &ContextHandler{
+		Handler: NewNamedHandler(name, func(m *types.Mail) error {
+			return handle(context.Background(), m)
+		}, condition),
+		handleContext: handle,
+	}
+}
+
+// Name 返回处理器名称
+func (h *Handler) Name() string {
+	return h.name
+}
+
 // Handle 实现 Handler 接口
 func (h *Handler) Handle(mail *types.Mail) error {
 	return h.handle(mail)
 }
 
+// HandleContext 实现 types.ContextHandler 接口
+func (h *ContextHandler) HandleContext(ctx context.Context, mail *types.Mail) error {
+	return h.handleContext(ctx, mail)
+}
+
 // Match 实现 Handler 接口
 func (h *Handler) Match(mail *types.Mail) bool {
 	return h.condition(mail)
@@ -123,6 +161,27 @@ func Cc(pattern string) Condition {
 	}
 }
 
+// EnvelopeFrom 创建信封发件人（MAIL FROM）匹配条件
+func EnvelopeFrom(pattern string) Condition {
+	re := regexp.MustCompile(pattern)
+	return func(m *types.Mail) bool {
+		return re.MatchString(m.Envelope.From)
+	}
+}
+
+// EnvelopeTo 创建信封收件人（RCPT TO）匹配条件，可匹配 BCC 和 catch-all 收件人
+func EnvelopeTo(pattern string) Condition {
+	re := regexp.MustCompile(pattern)
+	return func(m *types.Mail) bool {
+		for _, addr := range m.Envelope.To {
+			if re.MatchString(addr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // Subject 创建主题匹配条件
 func Subject(pattern string) Condition {
 	re := regexp.MustCompile(pattern)
@@ -165,21 +224,66 @@ func AttachmentName(pattern string) Condition {
 	}
 }
 
-// Header 创建邮件头匹配条件
+// Header 创建邮件头匹配条件，解析时未保留的头部从原始邮件中读取
 func Header(name, pattern string) Condition {
 	re := regexp.MustCompile(pattern)
+	key := textproto.CanonicalMIMEHeaderKey(name)
 	return func(m *types.Mail) bool {
-		if values, ok := m.Headers[name]; ok {
-			for _, v := range values {
-				if re.MatchString(v) {
-					return true
-				}
+		values, ok := m.Headers[name]
+		if !ok {
+			values = rawHeader(m, key)
+		}
+		for _, v := range values {
+			if re.MatchString(v) {
+				return true
 			}
 		}
 		return false
 	}
 }
 
+// rawHeader 从原始邮件中读取头部
+func rawHeader(m *types.Mail, name string) []string {
+	if len(m.Raw) == 0 {
+		return nil
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(m.Raw))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil
+	}
+	return header[name]
+}
+
+// Source 创建邮件源名称匹配条件
+func Source(pattern string) Condition {
+	re := regexp.MustCompile(pattern)
+	return func(m *types.Mail) bool {
+		return re.MatchString(m.Source)
+	}
+}
+
+// Folder 创建 IMAP 文件夹匹配条件
+func Folder(pattern string) Condition {
+	re := regexp.MustCompile(pattern)
+	return func(m *types.Mail) bool {
+		return re.MatchString(m.Envelope.Folder)
+	}
+}
+
+// SizeAtLeast 创建原始邮件不小于 n 字节的条件
+func SizeAtLeast(n int64) Condition {
+	return func(m *types.Mail) bool {
+		return int64(len(m.Raw)) >= n
+	}
+}
+
+// SizeAtMost 创建原始邮件不大于 n 字节的条件
+func SizeAtMost(n int64) Condition {
+	return func(m *types.Mail) bool {
+		return int64(len(m.Raw)) <= n
+	}
+}
+
 // TextContent 创建文本内容匹配条件
 func TextContent(pattern string) Condition {
 	re := regexp.MustCompile(pattern)
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
+)
+
+// RuleEnv 提供规则动作需要共享的处理器
+type RuleEnv struct {
+	// save 动作使用的处理器，通常为 SaveHandler
+	Save types.Handler
+}
+
+// action 是规则中的一个动作
+type action func(ctx context.Context, mail *types.Mail) error
+
+// NewRules 根据 config.yaml 中的 rules 创建处理器，顺序与配置相同
+func NewRules(configs []*types.RuleConfig, env RuleEnv) ([]types.Handler, error) {
+	rules := make([]types.Handler, 0, len(configs))
+	names := make(map[string]bool, len(configs))
+	for i, config := range configs {
+		if config == nil || config.Name == "" {
+			return nil, fmt.Errorf("rules[%d]: name is required", i)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("rules[%d]: duplicate rule name %q", i, config.Name)
+		}
+		names[config.Name] = true
+
+		rule, err := NewRule(config, env)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d] (%s): %v", i, config.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// NewRule 根据配置创建一个规则处理器，条件匹配时按顺序执行动作，某个动作失败后不再执行后续动作
+// 规则作为一个处理器重试，重试时所有动作重新执行，save 动作对同一封邮件只保存一次
+func NewRule(config *types.RuleConfig, env RuleEnv) (*ContextHandler, error) {
+	condition, err := NewCondition(&config.When, "when")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Actions) == 0 {
+		return nil, fmt.Errorf("actions: at least one action is required")
+	}
+	actions := make([]action, len(config.Actions))
+	for i, ac := range config.Actions {
+		if ac == nil {
+			return nil, fmt.Errorf("actions[%d]: action is empty", i)
+		}
+		if ac.Type == types.ActionDrop && i != len(config.Actions)-1 {
+			return nil, fmt.Errorf("actions[%d]: drop must be the last action", i)
+		}
+		if actions[i], err = newAction(ac, env); err != nil {
+			return nil, fmt.Errorf("actions[%d] (%s): %v", i, ac.Type, err)
+		}
+	}
+
+	return NewContextHandler(config.Name, func(ctx context.Context, mail *types.Mail) error {
+		for i, act := range actions {
+			err := act(ctx, mail)
+			if errors.Is(err, types.ErrDrop) {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("action %d (%s): %w", i, config.Actions[i].Type, err)
+			}
+		}
+		return nil
+	}, condition), nil
+}
+
+// newAction 根据配置创建动作
+func newAction(config *types.ActionConfig, env RuleEnv) (action, error) {
+	switch config.Type {
+	case types.ActionSave:
+		if env.Save == nil {
+			return nil, fmt.Errorf("save handler is not available")
+		}
+		return handlerAction(env.Save), nil
+	case types.ActionForward:
+		h, err := NewForwardHandler(ForwardConfig{
+			Server:   config.Server,
+			From:     config.From,
+			To:       config.To,
+			Username: config.Username,
+			Password: config.Password,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return handlerAction(h), nil
+	case types.ActionWebhook:
+		h, err := NewWebhookHandler(WebhookConfig{
+			URL:     config.URL,
+			Headers: config.Headers,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return handlerAction(h), nil
+	case types.ActionExec:
+		h, err := NewExecHandler(config.Command)
+		if err != nil {
+			return nil, err
+		}
+		return handlerAction(h), nil
+	case types.ActionTag:
+		if len(config.Tags) == 0 {
+			return nil, fmt.Errorf("tags are required")
+		}
+		return tagAction(config.Tags), nil
+	case types.ActionDrop:
+		return func(context.Context, *types.Mail) error { return types.ErrDrop }, nil
+	case "":
+		return nil, fmt.Errorf("type is required")
+	default:
+		return nil, fmt.Errorf("unknown action type %q, expected save, forward, webhook, exec, tag or drop", config.Type)
+	}
+}
+
+// handlerAction 将处理器作为动作执行，处理器的 Match 不再检查
+func handlerAction(h types.Handler) action {
+	return func(ctx context.Context, mail *types.Mail) error {
+		return utils.SafeHandleContext(ctx, h, mail)
+	}
+}
+
+// tagAction 给邮件添加标签，已有的标签不会重复添加
+func tagAction(tags []string) action {
+	return func(_ context.Context, mail *types.Mail) error {
+		for _, tag := range tags {
+			if !containsString(mail.Tags, tag) {
+				mail.Tags = append(mail.Tags, tag)
+			}
+		}
+		return nil
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCondition 根据配置创建匹配条件，path 为条件在配置中的位置，用于错误信息
+// 同一层中设置的字段需要全部满足，空条件匹配所有邮件
+func NewCondition(config *types.ConditionConfig, path string) (Condition, error) {
+	var conditions []Condition
+
+	// 先校验正则，避免构造器中的 MustCompile panic
+	patterns := []struct {
+		field, pattern string
+		build          func(string) Condition
+	}{
+		{"from", config.From, From},
+		{"to", config.To, To},
+		{"cc", config.Cc, Cc},
+		{"subject", config.Subject, Subject},
+		{"attachment", config.Attachment, AttachmentName},
+		{"content", config.Content, AnyContent},
+		{"source", config.Source, Source},
+		{"folder", config.Folder, Folder},
+	}
+	for _, p := range patterns {
+		if p.pattern == "" {
+			continue
+		}
+		if _, err := regexp.Compile(p.pattern); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", path, p.field, err)
+		}
+		conditions = append(conditions, p.build(p.pattern))
+	}
+	for name, pattern := range config.Header {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s.header.%s: %v", path, name, err)
+		}
+		conditions = append(conditions, Header(name, pattern))
+	}
+
+	if config.Expr != "" {
+		c, err := Expr(config.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s.expr: %v", path, err)
+		}
+		conditions = append(conditions, c)
+	}
+
+	if !config.DateAfter.IsZero() {
+		conditions = append(conditions, DateAfter(config.DateAfter))
+	}
+	if !config.DateBefore.IsZero() {
+		conditions = append(conditions, DateBefore(config.DateBefore))
+	}
+	if config.MinSize > 0 {
+		conditions = append(conditions, SizeAtLeast(config.MinSize))
+	}
+	if config.MaxSize > 0 {
+		if config.MaxSize < config.MinSize {
+			return nil, fmt.Errorf("%s.max_size: %d is smaller than min_size %d", path, config.MaxSize, config.MinSize)
+		}
+		conditions = append(conditions, SizeAtMost(config.MaxSize))
+	}
+
+	if len(config.And) > 0 {
+		and, err := newConditions(config.And, path+".and")
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, And(and...))
+	}
+	if len(config.Or) > 0 {
+		or, err := newConditions(config.Or, path+".or")
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, Or(or...))
+	}
+	if config.Not != nil {
+		not, err := NewCondition(config.Not, path+".not")
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, Not(not))
+	}
+
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+	return And(conditions...), nil
+}
+
+// newConditions 创建一组子条件
+func newConditions(configs []*types.ConditionConfig, path string) ([]Condition, error) {
+	conditions := make([]Condition, 0, len(configs))
+	for i, config := range configs {
+		if config == nil {
+			return nil, fmt.Errorf("%s[%d]: condition is empty", path, i)
+		}
+		c, err := NewCondition(config, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
+)
+
+const testRaw = "From: GitHub <noreply@github.com>\r\n" +
+	"To: dev@example.com\r\n" +
+	"Subject: [CI] Build failed\r\n" +
+	"X-Priority: 1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"The build on main failed.\r\n"
+
+func newTestMail(t *testing.T) *types.Mail {
+	t.Helper()
+	m, err := utils.ParseMail(strings.NewReader(testRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ID = "mail-1"
+	m.Source = "work"
+	m.Envelope.Folder = "INBOX"
+	return m
+}
+
+func TestNewCondition(t *testing.T) {
+	tests := []struct {
+		name   string
+		config types.ConditionConfig
+		want   bool
+	}{
+		{"empty matches all", types.ConditionConfig{}, true},
+		{"from", types.ConditionConfig{From: `@github\.com$`}, true},
+		{"from mismatch", types.ConditionConfig{From: `@gitlab\.com$`}, false},
+		{"to", types.ConditionConfig{To: `^dev@`}, true},
+		{"subject", types.ConditionConfig{Subject: `^\[CI\]`}, true},
+		{"header", types.ConditionConfig{Header: map[string]string{"X-Priority": "^1$"}}, true},
+		{"header mismatch", types.ConditionConfig{Header: map[string]string{"X-Priority": "^5$"}}, false},
+		{"content", types.ConditionConfig{Content: "build on main"}, true},
+		{"source and folder", types.ConditionConfig{Source: "^work$", Folder: "^INBOX$"}, true},
+		{"fields in one level are all required", types.ConditionConfig{From: "github", Subject: "deploy"}, false},
+		{"and", types.ConditionConfig{And: []*types.ConditionConfig{{From: "github"}, {Subject: "failed"}}}, true},
+		{"and with a mismatch", types.ConditionConfig{And: []*types.ConditionConfig{{From: "github"}, {Subject: "passed"}}}, false},
+		{"or", types.ConditionConfig{Or: []*types.ConditionConfig{{From: "gitlab"}, {Subject: "failed"}}}, true},
+		{"or without a match", types.ConditionConfig{Or: []*types.ConditionConfig{{From: "gitlab"}, {Subject: "passed"}}}, false},
+		{"not", types.ConditionConfig{Not: &types.ConditionConfig{From: "gitlab"}}, true},
+		{"not a match", types.ConditionConfig{Not: &types.ConditionConfig{From: "github"}}, false},
+		{"nested", types.ConditionConfig{
+			From: "github",
+			Or: []*types.ConditionConfig{
+				{Subject: "deploy"},
+				{Not: &types.ConditionConfig{Header: map[string]string{"X-Priority": "^5$"}}},
+			},
+		}, true},
+		{"expr", types.ConditionConfig{Expr: `any(from, .address endsWith "@github.com") && headers["x-priority"][0] == "1"`}, true},
+		{"expr mismatch", types.ConditionConfig{Expr: `size > 1e6`}, false},
+		{"expr runtime error does not match", types.ConditionConfig{Expr: `headers["x-missing"][0] == "1"`}, false},
+		{"expr with fields", types.ConditionConfig{Source: "work", Expr: `lower(subject) contains "failed"`}, true},
+	}
+	mail := newTestMail(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCondition(&tt.config, "rules[0].match")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c(mail); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewConditionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  types.ConditionConfig
+		wantErr string
+	}{
+		{"regex field", types.ConditionConfig{Subject: "["}, "rules[0].match.subject: "},
+		{"header regex", types.ConditionConfig{Header: map[string]string{"X-Priority": "("}}, "rules[0].match.header.X-Priority: "},
+		{"nested regex", types.ConditionConfig{Or: []*types.ConditionConfig{{}, {From: "("}}}, "rules[0].match.or[1].from: "},
+		{"not regex", types.ConditionConfig{Not: &types.ConditionConfig{To: "("}}, "rules[0].match.not.to: "},
+		{"empty sub-condition", types.ConditionConfig{And: []*types.ConditionConfig{nil}}, "rules[0].match.and[0]: condition is empty"},
+		{"expr unknown field", types.ConditionConfig{Expr: `sender == "a"`}, "rules[0].match.expr: compile expression error"},
+		{"expr not bool", types.ConditionConfig{Expr: `size`}, "rules[0].match.expr: compile expression error"},
+		{"max below min", types.ConditionConfig{MinSize: 10, MaxSize: 5}, "rules[0].match.max_size: 5 is smaller than min_size 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCondition(&tt.config, "rules[0].match")
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want prefix %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExprInvalid(t *testing.T) {
+	if _, err := Expr(`subject ==`); err == nil {
+		t.Error("Expr with a syntax error succeeded")
+	}
+	c, err := Expr(`subject startsWith "[CI]"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c(newTestMail(t)) {
+		t.Error("Expr did not match")
+	}
+}
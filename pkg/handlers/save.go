@@ -1,15 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
 	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
 )
 
 // SaveHandler 将邮件保存到 SQLite 数据库，附件保存到文件系统
@@ -34,7 +35,7 @@ func NewSaveHandler(config SaveConfig) (*SaveHandler, error) {
 	}
 
 	// 打开数据库连接
-	db, err := gorm.Open(sqlite.Open(config.DBPath), &gorm.Config{})
+	db, err := utils.OpenDB(config.DBPath)
 	if err != nil {
 		return nil, fmt.Errorf("open database error: %v", err)
 	}
@@ -61,11 +62,37 @@ func (h *SaveHandler) Close() error {
 
 // Handle 实现 Handler 接口
 func (h *SaveHandler) Handle(mail *types.Mail) error {
+	return h.HandleContext(context.Background(), mail)
+}
+
+// HandleContext 实现 ContextHandler 接口
+// 同一封邮件（相同的 source 和邮件 ID）只保存一次，再次保存时只更新标签，
+// 因此处理器重试、内置 save 与规则中的 save 动作同时执行都不会产生重复记录
+func (h *SaveHandler) HandleContext(ctx context.Context, mail *types.Mail) error {
 	// 转换为数据库模型
 	dbMail := types.FromMail(mail)
 
-	// 开始事务
-	return h.db.Transaction(func(tx *gorm.DB) error {
+	// 开始事务，数据库以 BEGIN IMMEDIATE 开始事务，查询和写入之间不会有其它写入
+	return h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if mail.ID != "" {
+			var existing []types.DBMail
+			err := tx.Select("id", "tags").
+				Where("mail_id = ? AND source = ?", dbMail.MailID, dbMail.Source).
+				Limit(1).Find(&existing).Error
+			if err != nil {
+				return fmt.Errorf("find saved mail error: %v", err)
+			}
+			if len(existing) > 0 {
+				if existing[0].Tags == dbMail.Tags {
+					return nil
+				}
+				if err := tx.Model(&existing[0]).Update("tags", dbMail.Tags).Error; err != nil {
+					return fmt.Errorf("update mail tags error: %v", err)
+				}
+				return nil
+			}
+		}
+
 		// 保存邮件及其关联数据
 		if err := tx.Create(dbMail).Error; err != nil {
 			return fmt.Errorf("save mail error: %v", err)
@@ -80,6 +107,11 @@ func (h *SaveHandler) Handle(mail *types.Mail) error {
 	})
 }
 
+// Name 返回处理器名称
+func (h *SaveHandler) Name() string {
+	return "save"
+}
+
 // Match 实现 Handler 接口
 func (h *SaveHandler) Match(mail *types.Mail) bool {
 	return true // 保存所有邮件
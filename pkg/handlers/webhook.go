@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// WebhookHandler 将邮件以 JSON 格式 POST 到指定的 URL
+type WebhookHandler struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+// WebhookConfig 配置 WebhookHandler
+type WebhookConfig struct {
+	// 接收邮件的 URL
+	URL string
+	// 额外的请求头，例如 Authorization
+	Headers map[string]string
+}
+
+// NewWebhookHandler 创建一个新的 WebhookHandler
+func NewWebhookHandler(config WebhookConfig) (*WebhookHandler, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	return &WebhookHandler{
+		config: config,
+		client: &http.Client{},
+	}, nil
+}
+
+// Handle 实现 Handler 接口
+func (h *WebhookHandler) Handle(mail *types.Mail) error {
+	return h.HandleContext(context.Background(), mail)
+}
+
+// HandleContext 实现 ContextHandler 接口
+// 4xx 响应视为永久失败（408、429 除外），其它非 2xx 响应视为临时失败
+func (h *WebhookHandler) HandleContext(ctx context.Context, mail *types.Mail) error {
+	body, err := json.Marshal(mail.ToAPIMail())
+	if err != nil {
+		return types.Permanent(fmt.Errorf("encode mail error: %v", err))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return types.Permanent(fmt.Errorf("create request error: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return types.Permanent(err)
+	}
+	return err
+}
+
+// Name 返回处理器名称
+func (h *WebhookHandler) Name() string {
+	return "webhook"
+}
+
+// Match 实现 Handler 接口
+func (h *WebhookHandler) Match(mail *types.Mail) bool {
+	return true
+}
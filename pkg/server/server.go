@@ -1,20 +1,26 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
 	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
 )
 
 //go:embed web/*
@@ -24,7 +30,11 @@ var webFS embed.FS
 type Server struct {
 	db            *gorm.DB
 	router        *gin.Engine
+	httpServer    *http.Server
 	attachmentDir string
+	handlers      HandlerRegistry
+	sources       SourceRegistry
+	authMu        sync.RWMutex
 	auth          struct {
 		username string
 		password string
@@ -37,18 +47,32 @@ type Config struct {
 	Username      string
 	Password      string
 	AttachmentDir string
+	Handlers      HandlerRegistry // 为空时不提供 /api/handlers
+	Sources       SourceRegistry  // 为空时不提供 /api/sources
+}
+
+// HandlerRegistry lists handlers and pauses or resumes them at runtime
+type HandlerRegistry interface {
+	Handlers() []types.HandlerInfo
+	EnableHandler(name string) error
+	DisableHandler(name string) error
+}
+
+// SourceRegistry lists the running sources and their connection state
+type SourceRegistry interface {
+	Sources() []types.SourceStatus
 }
 
 // New creates a new server instance
 func New(config Config) (*Server, error) {
 	// Open database connection
-	db, err := gorm.Open(sqlite.Open(config.DBPath), &gorm.Config{})
+	db, err := utils.OpenDB(config.DBPath)
 	if err != nil {
 		return nil, fmt.Errorf("open database error: %v", err)
 	}
 
 	// Auto migrate schemas
-	if err := db.AutoMigrate(&types.DBMail{}, &types.DBAddress{}, &types.DBAttachment{}); err != nil {
+	if err := types.Migrate(db); err != nil {
 		return nil, fmt.Errorf("auto migrate error: %v", err)
 	}
 
@@ -56,7 +80,10 @@ func New(config Config) (*Server, error) {
 		db:            db,
 		router:        gin.Default(),
 		attachmentDir: config.AttachmentDir,
+		handlers:      config.Handlers,
+		sources:       config.Sources,
 	}
+	s.httpServer = &http.Server{Handler: s.router}
 	s.auth.username = config.Username
 	s.auth.password = config.Password
 
@@ -75,16 +102,46 @@ func (s *Server) Close() error {
 	return sqlDB.Close()
 }
 
-// Run starts the HTTP server
+// Run starts the HTTP server, it returns http.ErrServerClosed after Shutdown
 func (s *Server) Run(addr string) error {
-	return s.router.Run(addr)
+	s.httpServer.Addr = addr
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown stops the HTTP server gracefully and closes the database
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return err
+	}
+	return s.Close()
 }
 
-// basicAuth middleware
+// SetAuth 修改 basic auth 账号，重新加载配置时不需要重启服务
+func (s *Server) SetAuth(username, password string) {
+	s.authMu.Lock()
+	s.auth.username = username
+	s.auth.password = password
+	s.authMu.Unlock()
+}
+
+// basicAuth middleware，每次请求读取当前的账号
 func (s *Server) basicAuth() gin.HandlerFunc {
-	return gin.BasicAuth(gin.Accounts{
-		s.auth.username: s.auth.password,
-	})
+	return func(c *gin.Context) {
+		s.authMu.RLock()
+		wantUser, wantPass := s.auth.username, s.auth.password
+		s.authMu.RUnlock()
+
+		user, pass, ok := c.Request.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set(gin.AuthUserKey, user)
+		c.Next()
+	}
 }
 
 // setupRoutes configures all the routes
@@ -107,6 +164,9 @@ func (s *Server) setupRoutes() {
 	s.router.GET("/mail/:id", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "mail.html", nil)
 	})
+	s.router.GET("/deadletters", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "deadletters.html", nil)
+	})
 
 	// API routes with basic auth
 	api := s.router.Group("/api", s.basicAuth())
@@ -116,23 +176,43 @@ func (s *Server) setupRoutes() {
 		api.GET("/mails/:id", s.getMail)
 		api.PUT("/mails/:id", s.updateMail)
 		api.DELETE("/mails/:id", s.deleteMail)
+		api.GET("/mails/:id/processing", s.getMailProcessing)
 
 		// Attachment routes
 		api.GET("/attachments/:id", s.downloadAttachment)
+
+		// Dead letter routes
+		api.GET("/deadletters", s.listDeadLetters)
+		api.POST("/deadletters/:id/retry", s.retryDeadLetter)
+		api.DELETE("/deadletters/:id", s.deleteDeadLetter)
+
+		// Handler routes
+		if s.handlers != nil {
+			api.GET("/handlers", s.listHandlers)
+			api.POST("/handlers/:name/enable", s.enableHandler)
+			api.POST("/handlers/:name/disable", s.disableHandler)
+		}
+
+		// Source routes
+		if s.sources != nil {
+			api.GET("/sources", s.listSources)
+		}
 	}
 }
 
 // QueryParams represents the query parameters for listing mails
 type QueryParams struct {
-	Page      int    `form:"page,default=1"`
-	PageSize  int    `form:"page_size,default=20"`
-	MailID    uint   `form:"mail_id"`
-	MessageID string `form:"message_id"`
-	StartDate string `form:"start_date"`
-	EndDate   string `form:"end_date"`
-	From      string `form:"from"`
-	To        string `form:"to"`
-	Keyword   string `form:"keyword"`
+	Page       int    `form:"page,default=1"`
+	PageSize   int    `form:"page_size,default=20"`
+	MailID     uint   `form:"mail_id"`
+	MessageID  string `form:"message_id"`
+	StartDate  string `form:"start_date"`
+	EndDate    string `form:"end_date"`
+	From       string `form:"from"`
+	To         string `form:"to"`
+	EnvelopeTo string `form:"envelope_to"`
+	Tag        string `form:"tag"`
+	Keyword    string `form:"keyword"`
 }
 
 // listMails handles GET /api/mails
@@ -180,6 +260,12 @@ func (s *Server) listMails(c *gin.Context) {
 		query = query.Joins("JOIN db_addresses a_to ON a_to.mail_id = db_mails.id AND a_to.type = 'to'").
 			Where("a_to.address LIKE ?", "%"+params.To+"%")
 	}
+	if params.EnvelopeTo != "" {
+		query = query.Where("envelope_to LIKE ?", "%"+params.EnvelopeTo+"%")
+	}
+	if params.Tag != "" {
+		query = query.Where("(',' || tags || ',') LIKE ?", "%,"+params.Tag+",%")
+	}
 	if params.Keyword != "" {
 		query = query.Where("(subject LIKE ? OR text_content LIKE ? OR html_content LIKE ?)",
 			"%"+params.Keyword+"%",
@@ -196,7 +282,8 @@ func (s *Server) listMails(c *gin.Context) {
 
 	// Get paginated records
 	var mails []types.DBMail
-	if err := query.Offset((params.Page - 1) * params.PageSize).
+	if err := query.Omit("raw").
+		Offset((params.Page - 1) * params.PageSize).
 		Limit(params.PageSize).
 		Order("date DESC").
 		Find(&mails).Error; err != nil {
@@ -223,7 +310,7 @@ func (s *Server) getMail(c *gin.Context) {
 	id := c.Param("id")
 
 	var mail types.DBMail
-	err := s.db.Preload(clause.Associations).First(&mail, id).Error
+	err := s.db.Preload(clause.Associations).Omit("raw").First(&mail, id).Error
 	if err == gorm.ErrRecordNotFound {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Mail not found"})
 		return
@@ -235,6 +322,39 @@ func (s *Server) getMail(c *gin.Context) {
 	c.JSON(http.StatusOK, mail.ToAPIMail())
 }
 
+// getMailProcessing handles GET /api/mails/:id/processing
+// 返回邮件在各个处理器上的匹配情况、耗时和结果，包括重试
+func (s *Server) getMailProcessing(c *gin.Context) {
+	id := c.Param("id")
+
+	var mail types.DBMail
+	err := s.db.Select("id", "mail_id", "source").First(&mail, id).Error
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mail not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var records []types.DBProcessing
+	if mail.MailID != "" {
+		if err := s.db.Where("mail_id = ? AND source = ?", mail.MailID, mail.Source).
+			Order("created_at, id").
+			Find(&records).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	apiRecords := make([]*types.APIProcessing, len(records))
+	for i := range records {
+		apiRecords[i] = records[i].ToAPIProcessing()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": apiRecords})
+}
+
 // UpdateMailRequest represents the request body for updating a mail
 type UpdateMailRequest struct {
 	Subject   *string `json:"subject"`
@@ -347,3 +467,139 @@ func (s *Server) downloadAttachment(c *gin.Context) {
 	c.Header("Content-Type", attachment.ContentType)
 	c.File(fullPath)
 }
+
+// DeadLetterQueryParams represents the query parameters for listing dead letters
+type DeadLetterQueryParams struct {
+	Page     int    `form:"page,default=1"`
+	PageSize int    `form:"page_size,default=20"`
+	Status   string `form:"status"`
+	Handler  string `form:"handler"`
+}
+
+// listDeadLetters handles GET /api/deadletters
+func (s *Server) listDeadLetters(c *gin.Context) {
+	var params DeadLetterQueryParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if params.Page < 1 {
+		params.Page = 1
+	}
+	if params.PageSize < 1 || params.PageSize > 100 {
+		params.PageSize = 20
+	}
+
+	query := s.db.Model(&types.DBDeadLetter{})
+	if params.Status != "" {
+		query = query.Where("status = ?", params.Status)
+	}
+	if params.Handler != "" {
+		query = query.Where("handler = ?", params.Handler)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var records []types.DBDeadLetter
+	if err := query.Omit("raw").
+		Offset((params.Page - 1) * params.PageSize).
+		Limit(params.PageSize).
+		Order("updated_at DESC").
+		Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	apiRecords := make([]*types.APIDeadLetter, len(records))
+	for i := range records {
+		apiRecords[i] = records[i].ToAPIDeadLetter()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":     total,
+		"page":      params.Page,
+		"page_size": params.PageSize,
+		"data":      apiRecords,
+	})
+}
+
+// retryDeadLetter handles POST /api/deadletters/:id/retry
+// 记录重新进入 retrying 状态，由 dispatcher 立即重试一次
+func (s *Server) retryDeadLetter(c *gin.Context) {
+	id := c.Param("id")
+
+	result := s.db.Model(&types.DBDeadLetter{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":          types.DeadLetterRetrying,
+		"next_attempt_at": time.Now(),
+	})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Retry scheduled"})
+}
+
+// deleteDeadLetter handles DELETE /api/deadletters/:id
+func (s *Server) deleteDeadLetter(c *gin.Context) {
+	id := c.Param("id")
+
+	result := s.db.Unscoped().Delete(&types.DBDeadLetter{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letter deleted successfully"})
+}
+
+// listHandlers handles GET /api/handlers
+func (s *Server) listHandlers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": s.handlers.Handlers()})
+}
+
+// enableHandler handles POST /api/handlers/:name/enable
+func (s *Server) enableHandler(c *gin.Context) {
+	s.setHandlerEnabled(c, s.handlers.EnableHandler, "Handler enabled")
+}
+
+// disableHandler handles POST /api/handlers/:name/disable
+func (s *Server) disableHandler(c *gin.Context) {
+	s.setHandlerEnabled(c, s.handlers.DisableHandler, "Handler disabled")
+}
+
+// setHandlerEnabled 调用 registry 修改处理器状态，处理器不存在时返回 404
+func (s *Server) setHandlerEnabled(c *gin.Context, set func(name string) error, message string) {
+	name := c.Param("name")
+
+	if err := set(name); err != nil {
+		if errors.Is(err, dispatcher.ErrHandlerNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Handler not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// listSources handles GET /api/sources
+func (s *Server) listSources(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": s.sources.Sources()})
+}
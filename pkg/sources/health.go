@@ -0,0 +1,111 @@
+package sources
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// 重新连接的等待时间从 reconnectMinBackoff 开始每次翻倍，最长 reconnectMaxBackoff
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 5 * time.Minute
+)
+
+// health 记录邮件源的连接状态、最近一次错误和最后一次成功检查的时间，
+// 嵌入到邮件源中提供 Status 方法
+type health struct {
+	mu     sync.RWMutex
+	status types.SourceStatus
+}
+
+func newHealth(name string, typ types.SourceType) *health {
+	return &health{status: types.SourceStatus{Name: name, Type: string(typ)}}
+}
+
+// Status 返回邮件源当前的状态
+func (h *health) Status() types.SourceStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.status
+}
+
+// connected 记录连接成功
+func (h *health) connected() {
+	h.mu.Lock()
+	h.status.Connected = true
+	h.mu.Unlock()
+}
+
+// disconnected 记录连接断开或连接失败，err 不为空时同时记为最近一次错误
+func (h *health) disconnected(err error) {
+	h.mu.Lock()
+	h.status.Connected = false
+	h.mu.Unlock()
+	if err != nil {
+		h.failed(err)
+	}
+}
+
+// polled 记录一次成功的检查
+func (h *health) polled() {
+	now := time.Now()
+	h.mu.Lock()
+	h.status.LastPollAt = &now
+	h.mu.Unlock()
+}
+
+// failed 记录最近一次错误
+func (h *health) failed(err error) {
+	now := time.Now()
+	h.mu.Lock()
+	h.status.LastError = err.Error()
+	h.status.LastErrorAt = &now
+	h.mu.Unlock()
+}
+
+// connectFirst 首次连接，失败时和连接断开一样按指数退避重试，期间状态为未连接，
+// done 关闭时放弃并返回 false
+func (h *health) connectFirst(done <-chan struct{}, connect func() error) bool {
+	err := connect()
+	if err == nil {
+		return true
+	}
+	h.disconnected(err)
+	log.Printf("%s source %s: %v, reconnecting", h.status.Type, h.status.Name, err)
+	return h.reconnect(done, connect)
+}
+
+// reconnect 按指数退避调用 connect 直到成功，done 关闭时放弃并返回 false
+func (h *health) reconnect(done <-chan struct{}, connect func() error) bool {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-done:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		if err := connect(); err != nil {
+			h.disconnected(err)
+			backoff *= 2
+			if backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+			log.Printf("%s source %s: reconnect attempt %d failed: %v, retrying in %s",
+				h.status.Type, h.status.Name, attempt, err, backoff)
+			continue
+		}
+
+		h.mu.Lock()
+		h.status.Connected = true
+		h.status.Reconnects++
+		h.mu.Unlock()
+		log.Printf("%s source %s: reconnected after %d attempt(s)", h.status.Type, h.status.Name, attempt)
+		return true
+	}
+}
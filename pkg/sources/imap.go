@@ -1,8 +1,12 @@
 package sources
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,41 +18,73 @@ import (
 
 // IMAPSource implements an IMAP client as a mail source
 type IMAPSource struct {
+	*health // 连接状态，连接断开后按指数退避重新连接
+
 	config     *types.IMAPConfig
 	client     *client.Client
+	tokens     TokenSource // 配置了 oauth2 时提供登录用的访问令牌
 	dispatcher types.Dispatcher
 	done       chan struct{}
+	wg         sync.WaitGroup // 等待 monitor 退出
+
+	wake chan struct{} // 收到新邮件通知（EXISTS）时唤醒 IDLE
 
-	mu            sync.RWMutex
-	uidValidity   uint32               // 当前邮箱的UIDVALIDITY
+	state       *StateStore     // 持久化同步进度，为 nil 时只保存在内存中
+	startFrom   types.StartFrom // 首次同步的起点
+	searchSince time.Time       // search.since
+
+	mu      sync.RWMutex
+	folders map[string]*folderState // 文件夹名称 -> 同步进度
+}
+
+// folderState 记录一个文件夹的同步进度，UID 只在同一个 UIDVALIDITY 内有效
+type folderState struct {
+	name          string
+	uidValidity   uint32               // 文件夹的UIDVALIDITY
 	processedUIDs map[uint32]time.Time // 记录已处理的消息UID和处理时间
 	lastUID       uint32               // 最后处理的消息UID
+	synced        bool                 // 首次同步已完成，之后每处理一封邮件都保存进度
 }
 
 // NewIMAPSource creates a new IMAP source
 func NewIMAPSource(config *types.IMAPConfig, dispatcher types.Dispatcher) (*IMAPSource, error) {
-	s := &IMAPSource{
-		config:        config,
-		dispatcher:    dispatcher,
-		done:          make(chan struct{}),
-		processedUIDs: make(map[uint32]time.Time),
+	if config == nil {
+		config = &types.IMAPConfig{TLS: true}
 	}
+	config.SetDefaults()
 
-	if config == nil {
-		config = &types.IMAPConfig{
-			TLS:      true,
-			Interval: 30 * time.Second,
-		}
+	startFrom, err := types.ParseStartFrom(config.StartFrom)
+	if err != nil {
+		return nil, err
+	}
+	searchSince, err := config.Search.SinceDate()
+	if err != nil {
+		return nil, fmt.Errorf("search since: %v", err)
 	}
 
-	// 启动清理过期记录的goroutine
-	go s.cleanProcessedUIDs()
+	s := &IMAPSource{
+		health:      newHealth(config.Name, types.SourceTypeIMAP),
+		config:      config,
+		dispatcher:  dispatcher,
+		done:        make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+		startFrom:   startFrom,
+		searchSince: searchSince,
+		folders:     make(map[string]*folderState),
+	}
+	if config.OAuth2 != nil {
+		if s.tokens, err = NewTokenSource(config.OAuth2); err != nil {
+			return nil, err
+		}
+	}
 
 	return s, nil
 }
 
-// cleanProcessedUIDs 定期清理超过24小时的记录
+// cleanProcessedUIDs 定期清理超过24小时的记录，源停止后退出
 func (s *IMAPSource) cleanProcessedUIDs() {
+	defer s.wg.Done()
+
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
@@ -59,9 +95,11 @@ func (s *IMAPSource) cleanProcessedUIDs() {
 		case <-ticker.C:
 			s.mu.Lock()
 			now := time.Now()
-			for uid, t := range s.processedUIDs {
-				if now.Sub(t) > 24*time.Hour {
-					delete(s.processedUIDs, uid)
+			for _, f := range s.folders {
+				for uid, t := range f.processedUIDs {
+					if now.Sub(t) > 24*time.Hour {
+						delete(f.processedUIDs, uid)
+					}
 				}
 			}
 			s.mu.Unlock()
@@ -69,20 +107,78 @@ func (s *IMAPSource) cleanProcessedUIDs() {
 	}
 }
 
+// SetStateStore 设置保存同步进度的 StateStore，需要在 Start 之前调用
+func (s *IMAPSource) SetStateStore(state *StateStore) {
+	s.state = state
+}
+
+// folderState 返回文件夹的同步进度，第一次访问时从数据库中读取。
+// UIDVALIDITY 改变时之前的记录失效，按 start_from 重新开始首次同步
+func (s *IMAPSource) folderState(name string, uidValidity uint32) (*folderState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f := s.folders[name]; f != nil && f.uidValidity == uidValidity {
+		return f, nil
+	}
+
+	f := &folderState{
+		name:          name,
+		uidValidity:   uidValidity,
+		processedUIDs: make(map[uint32]time.Time),
+	}
+	cursor, err := s.state.Cursor(s.Name(), name)
+	if err != nil {
+		return nil, fmt.Errorf("load sync state error: %v", err)
+	}
+	if cursor != nil && cursor.UIDValidity == uidValidity {
+		f.lastUID = cursor.LastUID
+		f.synced = true
+	}
+	s.folders[name] = f
+	return f, nil
+}
+
 // isProcessed 检查消息是否已处理过
-func (s *IMAPSource) isProcessed(uid uint32) bool {
+func (s *IMAPSource) isProcessed(f *folderState, uid uint32) bool {
 	s.mu.RLock()
-	_, exists := s.processedUIDs[uid]
+	_, exists := f.processedUIDs[uid]
 	s.mu.RUnlock()
 	return exists
 }
 
-// markProcessed 标记消息为已处理
-func (s *IMAPSource) markProcessed(uid uint32) {
+// markProcessed 标记消息为已处理，首次同步完成后同时保存进度
+func (s *IMAPSource) markProcessed(f *folderState, uid uint32) {
 	s.mu.Lock()
-	s.processedUIDs[uid] = time.Now()
-	s.lastUID = uid
+	f.processedUIDs[uid] = time.Now()
+	if uid > f.lastUID {
+		f.lastUID = uid
+	}
+	synced, lastUID := f.synced, f.lastUID
+	s.mu.Unlock()
+
+	if synced {
+		s.saveCursor(f, lastUID)
+	}
+}
+
+// finishFirstSync 完成首次同步并保存进度，UID 不大于 skipTo 的已有邮件不再处理
+func (s *IMAPSource) finishFirstSync(f *folderState, skipTo uint32) {
+	s.mu.Lock()
+	if skipTo > f.lastUID {
+		f.lastUID = skipTo
+	}
+	f.synced = true
+	lastUID := f.lastUID
 	s.mu.Unlock()
+
+	s.saveCursor(f, lastUID)
+}
+
+func (s *IMAPSource) saveCursor(f *folderState, lastUID uint32) {
+	if err := s.state.SaveCursor(s.Name(), f.name, f.uidValidity, lastUID); err != nil {
+		log.Printf("imap source %s: save sync state of %s error: %v", s.Name(), f.name, err)
+	}
 }
 
 // Start implements Source interface
@@ -93,36 +189,90 @@ func (s *IMAPSource) Start() error {
 	if s.config.Username == "" {
 		return fmt.Errorf("IMAP username is required")
 	}
-	if s.config.Password == "" {
-		return fmt.Errorf("IMAP password is required")
+	if s.config.Password == "" && s.tokens == nil {
+		return fmt.Errorf("IMAP password or oauth2 is required")
 	}
 
+	// Start monitoring for new messages, monitor connects in the background
+	log.Println("imap source is running...")
+	s.wg.Add(2)
+	go s.monitor()
+	go s.cleanProcessedUIDs()
+
+	return nil
+}
+
+// connect 连接服务器并登录，之前的连接已断开时直接替换
+func (s *IMAPSource) connect() error {
+	var c *client.Client
 	var err error
+	dialer := &net.Dialer{Timeout: imapDialTimeout, KeepAlive: imapKeepAlive}
 	if s.config.TLS {
-		s.client, err = client.DialTLS(s.config.Server, nil)
+		c, err = client.DialWithDialerTLS(dialer, s.config.Server, nil)
 	} else {
-		s.client, err = client.Dial(s.config.Server)
+		c, err = client.DialWithDialer(dialer, s.config.Server)
 	}
 	if err != nil {
 		return fmt.Errorf("connect error: %v", err)
 	}
+	c.Timeout = imapCommandTimeout
 
-	// Login
-	if err := s.client.Login(s.config.Username, s.config.Password); err != nil {
-		return fmt.Errorf("login error: %v", err)
+	if err := s.login(c); err != nil {
+		c.Terminate()
+		return err
 	}
 
-	// Start monitoring for new messages
-	log.Println("imap source is running...")
-	go s.monitor()
+	// 服务器主动推送的更新（IDLE 期间的 EXISTS 等）转为 wake 信号
+	updates := make(chan client.Update, 16)
+	c.Updates = updates
+	go s.forwardUpdates(c, updates)
+
+	s.client = c
+	s.connected()
+	return nil
+}
+
+// login 使用密码或 OAuth2 令牌登录
+func (s *IMAPSource) login(c *client.Client) error {
+	if s.tokens == nil {
+		if err := c.Login(s.config.Username, s.config.Password); err != nil {
+			return fmt.Errorf("login error: %v", err)
+		}
+		return nil
+	}
 
+	mech := s.config.OAuth2.Mechanism
+	if ok, err := c.SupportAuth(mech); err != nil {
+		return fmt.Errorf("capability error: %v", err)
+	} else if !ok {
+		return fmt.Errorf("login error: server does not support AUTH=%s", mech)
+	}
+	auth, err := newOAuth2Client(s.config.OAuth2, s.tokens, s.config.Username, s.config.Server)
+	if err != nil {
+		return fmt.Errorf("oauth2 token error: %v", err)
+	}
+	if err := c.Authenticate(auth); err != nil {
+		invalidateToken(s.tokens)
+		return fmt.Errorf("authenticate error: %v", err)
+	}
 	return nil
 }
 
+// lost 判断连接是否已断开
+func (s *IMAPSource) lost() bool {
+	select {
+	case <-s.client.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
 // Stop implements Source interface
 func (s *IMAPSource) Stop() error {
-	log.Println("smtp source is stopping...")
+	log.Println("imap source is stopping...")
 	close(s.done)
+	s.wg.Wait() // 等待正在进行的检查完成
 	if s.client != nil {
 		s.client.Logout()
 	}
@@ -134,7 +284,79 @@ func (s *IMAPSource) Name() string {
 	return s.config.Name
 }
 
+const (
+	// idleRestart 是一次 IDLE 的最长时间，到期后重新检查并重新 IDLE，
+	// 避免被服务器当作空闲连接断开（RFC 2177 建议不超过 29 分钟）
+	idleRestart = 25 * time.Minute
+	// idleStopTimeout 是结束 IDLE 后等待服务器确认的时间，超时后断开连接重新连接
+	idleStopTimeout = 30 * time.Second
+
+	// imapDialTimeout 是建立连接和等待服务器问候的超时时间
+	imapDialTimeout = 30 * time.Second
+	// imapKeepAlive 是 TCP keepalive 的间隔，用于发现 IDLE 期间已经断开的连接
+	imapKeepAlive = 30 * time.Second
+	// imapCommandTimeout 是一条命令的超时时间，服务器无响应时断开连接重新连接
+	imapCommandTimeout = 5 * time.Minute
+)
+
+// forwardUpdates 把邮箱更新转为 wake 信号，客户端不能被 Updates 阻塞
+func (s *IMAPSource) forwardUpdates(c *client.Client, updates <-chan client.Update) {
+	for {
+		select {
+		case update := <-updates:
+			if _, ok := update.(*client.MailboxUpdate); ok {
+				select {
+				case s.wake <- struct{}{}:
+				default:
+				}
+			}
+		case <-c.LoggedOut():
+			return
+		}
+	}
+}
+
+// monitor 连接服务器并监听新邮件，连接失败或断开后重新连接并登录，直到源被停止
 func (s *IMAPSource) monitor() {
+	defer s.wg.Done()
+
+	if !s.connectFirst(s.done, s.connect) {
+		return
+	}
+	for {
+		s.watch()
+
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		log.Printf("imap source %s: connection lost, reconnecting", s.Name())
+		s.disconnected(errors.New("connection lost"))
+		s.client.Terminate()
+		if !s.reconnect(s.done, s.connect) {
+			return
+		}
+	}
+}
+
+// watch 先检查一次新邮件，之后服务器支持 IDLE 时等待推送，否则按 check_interval 轮询，
+// 连接断开或源被停止时返回
+func (s *IMAPSource) watch() {
+	s.check()
+
+	if !s.config.DisableIdle {
+		if ok, err := s.client.Support("IDLE"); err == nil && ok {
+			s.idle()
+			return
+		}
+		log.Printf("imap source %s: server does not support IDLE, polling every %s", s.Name(), s.config.Interval)
+	}
+	s.poll()
+}
+
+// poll 按 check_interval 检查新邮件
+func (s *IMAPSource) poll() {
 	ticker := time.NewTicker(s.config.Interval)
 	defer ticker.Stop()
 
@@ -142,54 +364,226 @@ func (s *IMAPSource) monitor() {
 		select {
 		case <-s.done:
 			return
+		case <-s.client.LoggedOut():
+			return
 		case <-ticker.C:
-			if err := s.checkNewMessages(); err != nil {
-				// log error but continue monitoring
-				continue
+			s.check()
+		}
+	}
+}
+
+// idle 发出 IDLE 等待新邮件通知，收到通知或 idleRestart 到期后结束 IDLE 并检查新邮件
+func (s *IMAPSource) idle() {
+	for {
+		// 命令超时对整个 IDLE 生效，IDLE 期间放宽到 IDLE 的最长时间之后
+		timeout := s.idleTimeout()
+		s.client.Timeout = timeout + idleStopTimeout
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- s.client.Idle(stop, &client.IdleOptions{LogoutTimeout: -1})
+		}()
+
+		timer := time.NewTimer(timeout)
+		var err error
+		select {
+		case <-s.done:
+			s.stopIdle(stop, done)
+			timer.Stop()
+			s.client.Timeout = imapCommandTimeout // Stop 之后还要 LOGOUT
+			return
+		case <-s.wake:
+			err = s.stopIdle(stop, done)
+		case <-timer.C:
+			err = s.stopIdle(stop, done)
+		case err = <-done:
+		}
+		timer.Stop()
+		s.client.Timeout = imapCommandTimeout
+
+		if err != nil {
+			if s.lost() {
+				return
+			}
+			log.Printf("imap source %s: idle error: %v", s.Name(), err)
+			// IDLE 失败时等待一个检查间隔，避免连续重试
+			select {
+			case <-s.done:
+				return
+			case <-time.After(s.config.Interval):
 			}
 		}
+		s.check()
+	}
+}
+
+// stopIdle 结束 IDLE 并等待服务器确认，idleStopTimeout 内没有确认时断开连接
+func (s *IMAPSource) stopIdle(stop chan struct{}, done <-chan error) error {
+	close(stop)
+
+	timer := time.NewTimer(idleStopTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		log.Printf("imap source %s: server did not end IDLE within %s, disconnecting", s.Name(), idleStopTimeout)
+		s.client.Terminate()
+		return <-done
 	}
 }
 
+// idleTimeout 返回一次 IDLE 的最长时间。IDLE 只能等待一个文件夹，
+// 监听多个文件夹时其它文件夹仍按 check_interval 检查
+func (s *IMAPSource) idleTimeout() time.Duration {
+	if len(s.config.Folders) > 1 || hasWildcard(s.config.Folders[0]) {
+		return s.config.Interval
+	}
+	return idleRestart
+}
+
+// check 检查新邮件，错误只记录日志和状态，下次检查时重试
+func (s *IMAPSource) check() {
+	if err := s.checkNewMessages(); err != nil {
+		s.failed(err)
+		log.Printf("imap source %s: check new messages error: %v", s.Name(), err)
+		return
+	}
+	s.polled()
+}
+
+// checkNewMessages 依次检查每个文件夹，第一个文件夹最后检查，使 IDLE 停留在这个文件夹上
 func (s *IMAPSource) checkNewMessages() error {
-	// Select INBOX
-	mbox, err := s.client.Select("INBOX", false)
+	folders, err := s.listFolders()
 	if err != nil {
-		return err
+		return fmt.Errorf("list folders error: %v", err)
+	}
+	if len(folders) == 0 {
+		return fmt.Errorf("no folder matches %s", strings.Join(s.config.Folders, ", "))
 	}
 
-	// 检查UIDVALIDITY是否改变
-	if s.uidValidity != 0 && s.uidValidity != mbox.UidValidity {
-		// UIDVALIDITY改变，清空所有记录
-		s.mu.Lock()
-		s.uidValidity = mbox.UidValidity
-		s.processedUIDs = make(map[uint32]time.Time)
-		s.lastUID = 0
-		s.mu.Unlock()
+	var errs []string
+	for _, name := range append(folders[1:], folders[0]) {
+		if err := s.checkFolder(name); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
 	}
+	return nil
+}
+
+// hasWildcard 判断文件夹名称是否包含 LIST 通配符
+func hasWildcard(name string) bool {
+	return strings.ContainsAny(name, "*%")
+}
 
-	// 首次运行，记录UIDVALIDITY
-	if s.uidValidity == 0 {
-		s.uidValidity = mbox.UidValidity
+// listFolders 展开配置中的文件夹，通配符交给服务器的 LIST 命令匹配：
+// * 匹配任意字符（包括层级分隔符），% 不匹配层级分隔符
+func (s *IMAPSource) listFolders() ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
 	}
 
-	// 获取新消息
-	if mbox.Messages == 0 {
-		return nil
+	for _, pattern := range s.config.Folders {
+		if !hasWildcard(pattern) {
+			add(pattern)
+			continue
+		}
+
+		mailboxes := make(chan *imap.MailboxInfo, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- s.client.List("", pattern, mailboxes)
+		}()
+		var matched []string
+		for m := range mailboxes {
+			if !hasAttr(m.Attributes, imap.NoSelectAttr) {
+				matched = append(matched, m.Name)
+			}
+		}
+		if err := <-done; err != nil {
+			return nil, err
+		}
+		sort.Strings(matched)
+		for _, name := range matched {
+			add(name)
+		}
+	}
+	return names, nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFolder 获取文件夹中上次检查之后的新邮件
+func (s *IMAPSource) checkFolder(name string) error {
+	// 已选中该文件夹时不再重复 SELECT，新邮件由服务器在后续命令或 IDLE 中通知
+	mbox := s.client.Mailbox()
+	if mbox == nil || mbox.Name != name {
+		var err error
+		if mbox, err = s.client.Select(name, false); err != nil {
+			return err
+		}
 	}
 
-	// 构建搜索条件
-	criteria := &imap.SearchCriteria{
-		Uid: new(imap.SeqSet),
+	// UIDVALIDITY 改变时之前的 UID 失效，重新开始记录
+	folder, err := s.folderState(name, mbox.UidValidity)
+	if err != nil {
+		return err
 	}
 
 	s.mu.RLock()
-	lastUID := s.lastUID
+	lastUID, synced := folder.lastUID, folder.synced
 	s.mu.RUnlock()
 
-	// 如果有最后处理的UID，只获取更新的消息
-	if lastUID > 0 {
-		criteria.Uid.AddRange(lastUID+1, 0)
+	// 只获取最后处理的UID之后的消息
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(lastUID+1, 0)
+
+	// 首次同步按 start_from 跳过已有的邮件：now 全部跳过，日期只处理该日期之后的邮件，
+	// 处理完成后进度跳到已有邮件的最大 UID
+	var skipTo uint32
+	if !synced {
+		switch {
+		case s.startFrom.Now:
+			if skipTo, err = s.lastExistingUID(mbox); err != nil {
+				return err
+			}
+			s.finishFirstSync(folder, skipTo)
+			return nil
+		case s.startFrom.Since.IsZero():
+			// all 不跳过任何邮件，逐封保存进度
+			s.finishFirstSync(folder, 0)
+			synced = true
+		default:
+			if skipTo, err = s.lastExistingUID(mbox); err != nil {
+				return err
+			}
+			criteria.Since = s.startFrom.Since
+		}
+	}
+	s.addSearch(criteria)
+
+	// 获取新消息
+	if mbox.Messages == 0 {
+		if !synced {
+			s.finishFirstSync(folder, skipTo)
+		}
+		return nil
 	}
 
 	// 搜索新消息
@@ -197,8 +591,12 @@ func (s *IMAPSource) checkNewMessages() error {
 	if err != nil {
 		return err
 	}
+	uids = newerUIDs(uids, lastUID)
 
 	if len(uids) == 0 {
+		if !synced {
+			s.finishFirstSync(folder, skipTo)
+		}
 		return nil
 	}
 
@@ -206,8 +604,8 @@ func (s *IMAPSource) checkNewMessages() error {
 	seqSet := new(imap.SeqSet)
 	seqSet.AddNum(uids...)
 
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+	section := &imap.BodySectionName{Peek: s.config.Actions.Peek}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, section.FetchItem()}
 
 	messages := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
@@ -215,9 +613,11 @@ func (s *IMAPSource) checkNewMessages() error {
 		done <- s.client.UidFetch(seqSet, items, messages)
 	}()
 
+	var handled []uint32 // 分发成功的邮件，之后执行 actions
+	var dispatchErr error
 	for msg := range messages {
 		// 检查消息是否已处理
-		if s.isProcessed(msg.Uid) {
+		if msg.Uid <= lastUID || s.isProcessed(folder, msg.Uid) {
 			continue
 		}
 
@@ -232,17 +632,152 @@ func (s *IMAPSource) checkNewMessages() error {
 			continue
 		}
 
-		// Set a unique ID for the message
-		mail.ID = fmt.Sprintf("imap-%d-%d", s.uidValidity, msg.Uid)
+		mail.ID = imapMailID(name, folder.uidValidity, msg.Uid)
 		mail.Source = s.Name()
+		mail.Envelope = utils.EnvelopeFromHeaders(mail)
+		mail.Envelope.RemoteAddr = s.config.Server
+		mail.Envelope.TLS = s.config.TLS
+		mail.Envelope.Folder = name
+		mail.Envelope.ReceivedAt = msg.InternalDate
+		if mail.Envelope.ReceivedAt.IsZero() {
+			mail.Envelope.ReceivedAt = time.Now()
+		}
 
 		if err := s.dispatcher.Dispatch(mail); err != nil {
-			return err
+			if !types.IsPermanent(err) {
+				// 剩余的消息在下次检查时重新获取
+				dispatchErr = err
+				for range messages {
+				}
+				break
+			}
+			// 处理器明确拒绝的邮件不再重试
+			log.Printf("imap source %s: mail %s rejected: %v", s.Name(), mail.ID, err)
+		} else {
+			handled = append(handled, msg.Uid)
 		}
 
 		// 标记消息为已处理
-		s.markProcessed(msg.Uid)
+		s.markProcessed(folder, msg.Uid)
+	}
+	fetchErr := <-done
+
+	// 已分发的邮件即使后续出错也执行 actions
+	actionErr := s.applyActions(handled)
+	switch {
+	case dispatchErr != nil:
+		return dispatchErr
+	case fetchErr != nil:
+		return fetchErr
+	case actionErr != nil:
+		return actionErr
+	}
+	if !synced {
+		s.finishFirstSync(folder, skipTo)
+	}
+	return nil
+}
+
+// newerUIDs 去掉不大于 lastUID 的 UID。lastUID 之后没有新邮件时，
+// UID lastUID+1:* 仍然匹配最大的 UID（RFC 3501 6.4.8），不去掉会在重启后重复处理最后一封邮件
+func newerUIDs(uids []uint32, lastUID uint32) []uint32 {
+	newer := uids[:0]
+	for _, uid := range uids {
+		if uid > lastUID {
+			newer = append(newer, uid)
+		}
+	}
+	return newer
+}
+
+// addSearch 把 search 配置加入搜索条件，search.since 和 start_from 的日期取较晚的一个
+func (s *IMAPSource) addSearch(criteria *imap.SearchCriteria) {
+	search := s.config.Search
+	if search.Unseen {
+		criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+	}
+	if search.From != "" {
+		criteria.Header.Add("From", search.From)
+	}
+	if search.To != "" {
+		criteria.Header.Add("To", search.To)
+	}
+	if search.Subject != "" {
+		criteria.Header.Add("Subject", search.Subject)
+	}
+	if s.searchSince.After(criteria.Since) {
+		criteria.Since = s.searchSince
+	}
+}
+
+// applyActions 对分发成功的邮件依次添加标记、移动和删除
+func (s *IMAPSource) applyActions(uids []uint32) error {
+	actions := s.config.Actions
+	if len(uids) == 0 {
+		return nil
 	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	// 标记是 atom，不能按字符串加引号发送
+	var flags []interface{}
+	if actions.Seen {
+		flags = append(flags, imap.RawString(imap.SeenFlag))
+	}
+	for _, flag := range actions.Flags {
+		flags = append(flags, imap.RawString(flag))
+	}
+	if actions.Delete {
+		flags = append(flags, imap.RawString(imap.DeletedFlag))
+	}
+	if len(flags) > 0 {
+		if err := s.client.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+			return fmt.Errorf("store flags error: %v", err)
+		}
+	}
+
+	// 标记在移动之前设置，随邮件一起移动；服务器不支持 MOVE 时用 COPY、STORE 和 EXPUNGE 代替
+	if actions.MoveTo != "" {
+		if err := s.client.UidMove(seqSet, actions.MoveTo); err != nil {
+			return fmt.Errorf("move to %s error: %v", actions.MoveTo, err)
+		}
+	}
+
+	// EXPUNGE 会同时删除文件夹中其它已设置 \Deleted 的邮件
+	if actions.Delete {
+		if err := s.client.Expunge(nil); err != nil {
+			return fmt.Errorf("expunge error: %v", err)
+		}
+	}
+	return nil
+}
 
-	return <-done
+// lastExistingUID 返回文件夹中已有邮件的最大 UID，服务器没有返回 UIDNEXT 时通过搜索获取
+func (s *IMAPSource) lastExistingUID(mbox *imap.MailboxStatus) (uint32, error) {
+	if mbox.UidNext > 0 {
+		return mbox.UidNext - 1, nil
+	}
+	if mbox.Messages == 0 {
+		return 0, nil
+	}
+	uids, err := s.client.UidSearch(imap.NewSearchCriteria())
+	if err != nil {
+		return 0, err
+	}
+	var last uint32
+	for _, uid := range uids {
+		if uid > last {
+			last = uid
+		}
+	}
+	return last, nil
+}
+
+// imapMailID 生成邮件 ID。UID 只在文件夹内唯一，其它文件夹的 ID 带上文件夹名称；
+// INBOX 沿用监听多个文件夹之前的格式，升级后已保存的邮件不会被重复保存
+func imapMailID(folder string, uidValidity, uid uint32) string {
+	if strings.EqualFold(folder, "INBOX") {
+		return fmt.Sprintf("imap-%d-%d", uidValidity, uid)
+	}
+	return fmt.Sprintf("imap-%s-%d-%d", folder, uidValidity, uid)
 }
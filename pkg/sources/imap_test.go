@@ -0,0 +1,229 @@
+package sources
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// recordDispatcher 记录收到的邮件
+type recordDispatcher struct {
+	mu    sync.Mutex
+	mails []*types.Mail
+}
+
+func (d *recordDispatcher) Dispatch(mail *types.Mail) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mails = append(d.mails, mail)
+	return nil
+}
+
+func (d *recordDispatcher) AddHandlers(...types.Handler) error    { return nil }
+func (d *recordDispatcher) RemoveHandlers(...types.Handler) error { return nil }
+
+func (d *recordDispatcher) ids() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]string, len(d.mails))
+	for i, mail := range d.mails {
+		ids[i] = mail.ID
+	}
+	return ids
+}
+
+// rfcBackend 包装内存后端，使 UID 搜索中的 n:* 和真实服务器一样在 n 大于最大 UID 时
+// 匹配最大的 UID（RFC 3501 6.4.8），内存后端把 * 当作无穷大
+type rfcBackend struct {
+	*memory.Backend
+}
+
+func (be rfcBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return rfcUser{u}, nil
+}
+
+type rfcUser struct {
+	backend.User
+}
+
+func (u rfcUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return rfcMailbox{mbox.(*memory.Mailbox)}, nil
+}
+
+type rfcMailbox struct {
+	*memory.Mailbox
+}
+
+func (mbox rfcMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if criteria.Uid != nil && len(mbox.Messages) > 0 {
+		last := mbox.Messages[len(mbox.Messages)-1].Uid
+		for i, seq := range criteria.Uid.Set {
+			if seq.Stop == 0 && seq.Start > last {
+				criteria.Uid.Set[i] = imap.Seq{Start: last, Stop: last}
+			}
+		}
+	}
+	return mbox.Mailbox.SearchMessages(uid, criteria)
+}
+
+// startIMAPServer 启动使用内存后端的 IMAP 服务器，账号为 username / password，
+// INBOX 中有一封 UID 为 6 的邮件。setup 在开始监听之前调用
+func startIMAPServer(t *testing.T, setup func(*server.Server, *memory.Backend)) string {
+	t.Helper()
+	be := memory.New()
+	srv := server.New(rfcBackend{be})
+	srv.AllowInsecureAuth = true
+	if setup != nil {
+		setup(srv, be)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// appendMail 通过 IMAP APPEND 向 INBOX 添加一封邮件
+func appendMail(t *testing.T, addr, subject string) {
+	t.Helper()
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	body := "From: a@example.com\r\nTo: b@example.com\r\nSubject: " + subject + "\r\n\r\nhello\r\n"
+	if err := c.Append("INBOX", nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestStateStore(t *testing.T) *StateStore {
+	t.Helper()
+	state, err := NewStateStore(filepath.Join(t.TempDir(), "emails.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.Close() })
+	return state
+}
+
+// newTestIMAPSource 创建并连接 IMAP 源，不启动 monitor，由测试直接调用 checkFolder
+func newTestIMAPSource(t *testing.T, config *types.IMAPConfig, state *StateStore, d types.Dispatcher) *IMAPSource {
+	t.Helper()
+	s, err := NewIMAPSource(config, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetStateStore(state)
+	if err := s.connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func checkInbox(t *testing.T, s *IMAPSource) {
+	t.Helper()
+	if err := s.checkFolder("INBOX"); err != nil {
+		t.Fatalf("check INBOX: %v", err)
+	}
+}
+
+func assertIDs(t *testing.T, d *recordDispatcher, want ...string) {
+	t.Helper()
+	got := d.ids()
+	if len(got) != len(want) {
+		t.Fatalf("dispatched %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("dispatched %v, want %v", got, want)
+		}
+	}
+}
+
+func TestIMAPRestartDoesNotRedispatchLastMail(t *testing.T) {
+	addr := startIMAPServer(t, nil)
+	state := newTestStateStore(t)
+	config := &types.IMAPConfig{Name: "box", Server: addr, Username: "username", Password: "password"}
+
+	d := &recordDispatcher{}
+	s := newTestIMAPSource(t, config, state, d)
+	checkInbox(t, s)
+	checkInbox(t, s)
+	assertIDs(t, d, "imap-1-6")
+
+	// 重启后 processedUIDs 为空，UID 7:* 仍然匹配 UID 6
+	restarted := &recordDispatcher{}
+	s = newTestIMAPSource(t, config, state, restarted)
+	checkInbox(t, s)
+	assertIDs(t, restarted)
+
+	appendMail(t, addr, "new")
+	checkInbox(t, s)
+	checkInbox(t, s)
+	assertIDs(t, restarted, "imap-1-7")
+}
+
+func TestIMAPStartFromNowSkipsExistingMail(t *testing.T) {
+	addr := startIMAPServer(t, nil)
+	state := newTestStateStore(t)
+	config := &types.IMAPConfig{Name: "box", Server: addr, Username: "username", Password: "password", StartFrom: "now"}
+
+	d := &recordDispatcher{}
+	s := newTestIMAPSource(t, config, state, d)
+	checkInbox(t, s)
+	checkInbox(t, s)
+	assertIDs(t, d)
+
+	appendMail(t, addr, "new")
+	checkInbox(t, s)
+	checkInbox(t, s)
+	assertIDs(t, d, "imap-1-7")
+
+	restarted := &recordDispatcher{}
+	s = newTestIMAPSource(t, config, state, restarted)
+	checkInbox(t, s)
+	assertIDs(t, restarted)
+}
+
+func TestIMAPMailID(t *testing.T) {
+	tests := []struct {
+		folder string
+		want   string
+	}{
+		{"INBOX", "imap-7-42"},
+		{"inbox", "imap-7-42"},
+		{"Alerts/Prod", "imap-Alerts/Prod-7-42"},
+	}
+	for _, tt := range tests {
+		if got := imapMailID(tt.folder, 7, 42); got != tt.want {
+			t.Errorf("imapMailID(%q) = %q, want %q", tt.folder, got, tt.want)
+		}
+	}
+}
@@ -16,12 +16,20 @@ import (
 
 // MailHogSource implements a MailHog API client as a mail source
 type MailHogSource struct {
+	*health // API 是否可以访问
+
 	config     *types.MailHogConfig
 	client     *http.Client
 	dispatcher types.Dispatcher
 	done       chan struct{}
+	wg         sync.WaitGroup // 等待 monitor 退出
+
+	state     *StateStore     // 持久化已处理的消息 ID，为 nil 时只保存在内存中
+	startFrom types.StartFrom // 首次同步的起点
 
 	mu           sync.RWMutex
+	loaded       bool // 已从数据库中读取 processedIDs
+	synced       bool // 首次同步已完成
 	lastID       data.MessageID
 	processedIDs map[data.MessageID]time.Time // 记录已处理的消息ID和处理时间
 }
@@ -36,47 +44,74 @@ type APIResponse struct {
 
 // NewMailHogSource creates a new MailHog source
 func NewMailHogSource(config *types.MailHogConfig, dispatcher types.Dispatcher) (*MailHogSource, error) {
+	if config == nil {
+		config = &types.MailHogConfig{}
+	}
+	config.SetDefaults()
+
+	startFrom, err := types.ParseStartFrom(config.StartFrom)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &MailHogSource{
+		health:       newHealth(config.Name, types.SourceTypeMailHog),
 		config:       config,
 		dispatcher:   dispatcher,
 		client:       &http.Client{Timeout: 10 * time.Second},
 		done:         make(chan struct{}),
+		startFrom:    startFrom,
 		processedIDs: make(map[data.MessageID]time.Time),
 	}
 
-	if config == nil {
-		config = &types.MailHogConfig{
-			APIURL:   "http://localhost:8025",
-			Interval: 5 * time.Second,
-		}
-	}
-
-	// 启动清理过期记录的goroutine
-	go s.cleanProcessedIDs()
-
 	return s, nil
 }
 
-// cleanProcessedIDs 定期清理超过24小时的记录
-func (s *MailHogSource) cleanProcessedIDs() {
-	ticker := time.NewTicker(1 * time.Hour)
-	defer ticker.Stop()
+// SetStateStore 设置保存同步进度的 StateStore，需要在 Start 之前调用
+func (s *MailHogSource) SetStateStore(state *StateStore) {
+	s.state = state
+}
 
-	for {
-		select {
-		case <-s.done:
-			return
-		case <-ticker.C:
-			s.mu.Lock()
-			now := time.Now()
-			for id, t := range s.processedIDs {
-				if now.Sub(t) > 24*time.Hour {
-					delete(s.processedIDs, id)
-				}
-			}
-			s.mu.Unlock()
+// loadState 第一次检查时从数据库中读取已处理的消息 ID 和首次同步是否已完成
+func (s *MailHogSource) loadState() error {
+	if s.loaded {
+		return nil
+	}
+	seen, err := s.state.Seen(s.Name())
+	if err != nil {
+		return fmt.Errorf("load sync state error: %v", err)
+	}
+	cursor, err := s.state.Cursor(s.Name(), "")
+	if err != nil {
+		return fmt.Errorf("load sync state error: %v", err)
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for id := range seen {
+		s.processedIDs[data.MessageID(id)] = now
+	}
+	s.mu.Unlock()
+	s.loaded = true
+	s.synced = cursor != nil
+	return nil
+}
+
+// forgetDeleted 删除已不在 MailHog 中的消息记录
+func (s *MailHogSource) forgetDeleted(current map[data.MessageID]bool) {
+	var deleted []string
+	s.mu.Lock()
+	for id := range s.processedIDs {
+		if !current[id] {
+			deleted = append(deleted, string(id))
+			delete(s.processedIDs, id)
 		}
 	}
+	s.mu.Unlock()
+
+	if err := s.state.Forget(s.Name(), deleted); err != nil {
+		log.Printf("mailhog source %s: save sync state error: %v", s.Name(), err)
+	}
 }
 
 // isProcessed 检查消息是否已经处理过
@@ -87,11 +122,20 @@ func (s *MailHogSource) isProcessed(id data.MessageID) bool {
 	return exists
 }
 
-// markProcessed 标记消息为已处理
-func (s *MailHogSource) markProcessed(id data.MessageID) {
+// markProcessed 标记消息为已处理并保存到数据库
+func (s *MailHogSource) markProcessed(ids ...data.MessageID) {
 	s.mu.Lock()
-	s.processedIDs[id] = time.Now()
+	now := time.Now()
+	seen := make([]string, len(ids))
+	for i, id := range ids {
+		s.processedIDs[id] = now
+		seen[i] = string(id)
+	}
 	s.mu.Unlock()
+
+	if err := s.state.MarkSeen(s.Name(), seen...); err != nil {
+		log.Printf("mailhog source %s: save sync state error: %v", s.Name(), err)
+	}
 }
 
 // Start implements Source interface
@@ -101,7 +145,8 @@ func (s *MailHogSource) Start() error {
 	}
 
 	// Start monitoring for new messages
-	log.Println("imap source is running...")
+	log.Println("mailhog source is running...")
+	s.wg.Add(1)
 	go s.monitor()
 
 	return nil
@@ -109,8 +154,9 @@ func (s *MailHogSource) Start() error {
 
 // Stop implements Source interface
 func (s *MailHogSource) Stop() error {
-	log.Println("imap source is stopping...")
+	log.Println("mailhog source is stopping...")
 	close(s.done)
+	s.wg.Wait() // 等待正在进行的检查完成
 	return nil
 }
 
@@ -120,6 +166,8 @@ func (s *MailHogSource) Name() string {
 }
 
 func (s *MailHogSource) monitor() {
+	defer s.wg.Done()
+
 	ticker := time.NewTicker(s.config.Interval)
 	defer ticker.Stop()
 
@@ -129,29 +177,65 @@ func (s *MailHogSource) monitor() {
 			return
 		case <-ticker.C:
 			if err := s.checkNewMessages(); err != nil {
-				// log error but continue monitoring
+				s.failed(err)
+				log.Printf("mailhog source %s: check new messages error: %v", s.Name(), err)
 				continue
 			}
+			s.polled()
 		}
 	}
 }
 
 func (s *MailHogSource) checkNewMessages() error {
+	if err := s.loadState(); err != nil {
+		return err
+	}
+
 	resp, err := s.client.Get(fmt.Sprintf("%s/api/v2/messages", s.config.APIURL))
 	if err != nil {
+		s.disconnected(nil)
 		return fmt.Errorf("API request error: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		s.disconnected(nil)
 		return fmt.Errorf("API error: %s", resp.Status)
 	}
+	s.connected()
 
 	var apiResp APIResponse
 	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
 		return fmt.Errorf("JSON decode error: %v", err)
 	}
 
+	// 只有返回了全部消息时才能判断哪些消息已被删除
+	if len(apiResp.Items) >= apiResp.Total {
+		current := make(map[data.MessageID]bool, len(apiResp.Items))
+		for _, msg := range apiResp.Items {
+			current[msg.ID] = true
+		}
+		s.forgetDeleted(current)
+	}
+
+	// 首次同步按 start_from 把要跳过的已有邮件标记为已处理
+	if !s.synced {
+		var skip []data.MessageID
+		for _, msg := range apiResp.Items {
+			if s.isProcessed(msg.ID) {
+				continue
+			}
+			if s.startFrom.Now || msg.Created.Before(s.startFrom.Since) {
+				skip = append(skip, msg.ID)
+			}
+		}
+		s.markProcessed(skip...)
+		if err := s.state.SaveCursor(s.Name(), "", 0, 0); err != nil {
+			return fmt.Errorf("save sync state error: %v", err)
+		}
+		s.synced = true
+	}
+
 	// Process messages in reverse order (oldest first)
 	for i := len(apiResp.Items) - 1; i >= 0; i-- {
 		msg := apiResp.Items[i]
@@ -170,9 +254,14 @@ func (s *MailHogSource) checkNewMessages() error {
 		// Set message ID from MailHog
 		mail.ID = string(msg.ID)
 		mail.Source = s.Name()
+		mail.Envelope = mailHogEnvelope(&msg)
 
 		if err := s.dispatcher.Dispatch(mail); err != nil {
-			return fmt.Errorf("dispatch error: %v", err)
+			if !types.IsPermanent(err) {
+				return fmt.Errorf("dispatch error: %v", err)
+			}
+			// 处理器明确拒绝的邮件不再重试
+			log.Printf("mailhog source %s: mail %s rejected: %v", s.Name(), mail.ID, err)
 		}
 
 		// 标记消息为已处理
@@ -188,3 +277,32 @@ func (s *MailHogSource) checkNewMessages() error {
 
 	return nil
 }
+
+// mailHogEnvelope 从 MailHog 记录的 SMTP 会话中还原信封信息
+func mailHogEnvelope(msg *data.Message) types.Envelope {
+	env := types.Envelope{
+		ReceivedAt: msg.Created,
+	}
+	if msg.Raw != nil {
+		env.From = msg.Raw.From
+		env.To = append(env.To, msg.Raw.To...)
+		env.Helo = msg.Raw.Helo
+	}
+	if env.From == "" && msg.From != nil {
+		env.From = pathAddress(msg.From)
+	}
+	if len(env.To) == 0 {
+		for _, p := range msg.To {
+			env.To = append(env.To, pathAddress(p))
+		}
+	}
+	return env
+}
+
+// pathAddress 将 MailHog 的 Path 转换为邮件地址
+func pathAddress(p *data.Path) string {
+	if p.Domain == "" {
+		return p.Mailbox
+	}
+	return p.Mailbox + "@" + p.Domain
+}
@@ -0,0 +1,204 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// TokenSource 提供 OAuth2 访问令牌，每次登录前调用
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// NewTokenSource 根据配置创建 TokenSource：固定令牌、令牌文件或 refresh token
+func NewTokenSource(config *types.OAuth2Config) (TokenSource, error) {
+	n := 0
+	for _, v := range []string{config.Token, config.TokenFile, config.RefreshToken} {
+		if v != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("oauth2 requires exactly one of token, token_file or refresh_token")
+	}
+
+	switch {
+	case config.Token != "":
+		return staticTokenSource(config.Token), nil
+	case config.TokenFile != "":
+		return fileTokenSource(config.TokenFile), nil
+	default:
+		if config.TokenURL == "" || config.ClientID == "" {
+			return nil, fmt.Errorf("oauth2 refresh_token requires token_url and client_id")
+		}
+		return &refreshTokenSource{
+			config:       config,
+			refreshToken: config.RefreshToken,
+			client:       &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+}
+
+// staticTokenSource 总是返回配置中的令牌
+type staticTokenSource string
+
+func (t staticTokenSource) Token() (string, error) {
+	return string(t), nil
+}
+
+// fileTokenSource 每次登录时重新读取令牌文件，文件由其他程序负责更新
+type fileTokenSource string
+
+func (f fileTokenSource) Token() (string, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("read token file error: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", string(f))
+	}
+	return token, nil
+}
+
+// refreshTokenSource 用 refresh token 向令牌端点换取访问令牌，缓存到过期前一分钟
+type refreshTokenSource struct {
+	config *types.OAuth2Config
+	client *http.Client
+
+	mu           sync.Mutex
+	refreshToken string // 令牌端点返回新的 refresh token 时替换（只保存在内存中）
+	token        string
+	expiry       time.Time
+}
+
+// tokenResponse 是令牌端点的响应，见 RFC 6749 5.1 和 5.2
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	RefreshToken     string      `json:"refresh_token"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+func (r *refreshTokenSource) Token() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.token != "" && time.Now().Before(r.expiry) {
+		return r.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {r.refreshToken},
+		"client_id":     {r.config.ClientID},
+	}
+	if r.config.ClientSecret != "" {
+		form.Set("client_secret", r.config.ClientSecret)
+	}
+	if len(r.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(r.config.Scopes, " "))
+	}
+
+	resp, err := r.client.PostForm(r.config.TokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("refresh token error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("read token response error: %v", err)
+	}
+	var result tokenResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("refresh token error: status %d, invalid response: %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Error != "" {
+		msg := result.Error
+		if result.ErrorDescription != "" {
+			msg += ": " + result.ErrorDescription
+		}
+		return "", fmt.Errorf("refresh token error: status %d, %s", resp.StatusCode, msg)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("refresh token error: response has no access_token")
+	}
+
+	if result.RefreshToken != "" {
+		r.refreshToken = result.RefreshToken
+	}
+	// 没有 expires_in 时不缓存，每次登录都重新获取
+	r.token, r.expiry = "", time.Time{}
+	if expiresIn, err := result.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		r.token = result.AccessToken
+		r.expiry = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	}
+	return result.AccessToken, nil
+}
+
+// invalidate 丢弃缓存的访问令牌，服务器拒绝令牌（如已被撤销）后下次登录重新获取
+func (r *refreshTokenSource) invalidate() {
+	r.mu.Lock()
+	r.token, r.expiry = "", time.Time{}
+	r.mu.Unlock()
+}
+
+// invalidateToken 在登录失败后丢弃 TokenSource 缓存的令牌
+func invalidateToken(tokens TokenSource) {
+	if t, ok := tokens.(interface{ invalidate() }); ok {
+		t.invalidate()
+	}
+}
+
+// newOAuth2Client 获取访问令牌并创建配置的 SASL 机制，server 用于 OAUTHBEARER 的 host 和 port
+func newOAuth2Client(config *types.OAuth2Config, tokens TokenSource, username, server string) (sasl.Client, error) {
+	token, err := tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Mechanism {
+	case types.OAuth2MechanismOAuthBearer:
+		opts := &sasl.OAuthBearerOptions{Username: username, Token: token}
+		if host, port, err := net.SplitHostPort(server); err == nil {
+			opts.Host = host
+			opts.Port, _ = strconv.Atoi(port)
+		}
+		return sasl.NewOAuthBearerClient(opts), nil
+	case types.OAuth2MechanismXOAuth2:
+		return &xoauth2Client{username: username, token: token}, nil
+	default:
+		return nil, fmt.Errorf("unsupported oauth2 mechanism %q", config.Mechanism)
+	}
+}
+
+// xoauth2Client 实现 Google 和 Microsoft 使用的 XOAUTH2 机制，go-sasl 中没有提供
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return types.OAuth2MechanismXOAuth2, ir, nil
+}
+
+// Next 处理服务器在认证失败时返回的 JSON 错误信息
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return nil, fmt.Errorf("XOAUTH2 authentication error: %s", strings.TrimSpace(string(challenge)))
+}
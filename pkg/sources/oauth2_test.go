@@ -0,0 +1,428 @@
+package sources
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// tokenEndpoint 是测试用的令牌端点，按顺序返回 responses 中的响应并记录收到的表单
+type tokenEndpoint struct {
+	mu        sync.Mutex
+	forms     []url.Values
+	responses []tokenEndpointResponse
+}
+
+type tokenEndpointResponse struct {
+	status int
+	body   string
+}
+
+func (e *tokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.forms = append(e.forms, r.PostForm)
+	resp := e.responses[0]
+	if len(e.responses) > 1 {
+		e.responses = e.responses[1:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	fmt.Fprint(w, resp.body)
+}
+
+func (e *tokenEndpoint) requests() []url.Values {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]url.Values(nil), e.forms...)
+}
+
+// newRefreshTokenSource 创建使用 responses 作为令牌端点的 refreshTokenSource
+func newRefreshTokenSource(t *testing.T, responses ...tokenEndpointResponse) (TokenSource, *tokenEndpoint) {
+	t.Helper()
+	endpoint := &tokenEndpoint{responses: responses}
+	srv := httptest.NewServer(endpoint)
+	t.Cleanup(srv.Close)
+
+	tokens, err := NewTokenSource(&types.OAuth2Config{
+		TokenURL:     srv.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RefreshToken: "refresh-1",
+		Scopes:       []string{"mail.read", "offline_access"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens, endpoint
+}
+
+func mustToken(t *testing.T, tokens TokenSource, want string) {
+	t.Helper()
+	got, err := tokens.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if got != want {
+		t.Fatalf("Token = %q, want %q", got, want)
+	}
+}
+
+func TestRefreshTokenSourceCachesUntilInvalidated(t *testing.T) {
+	tokens, endpoint := newRefreshTokenSource(t,
+		tokenEndpointResponse{http.StatusOK, `{"access_token":"access-1","expires_in":3600}`},
+		tokenEndpointResponse{http.StatusOK, `{"access_token":"access-2","expires_in":"3600"}`},
+	)
+
+	mustToken(t, tokens, "access-1")
+	mustToken(t, tokens, "access-1")
+	if n := len(endpoint.requests()); n != 1 {
+		t.Fatalf("token endpoint called %d times, want 1", n)
+	}
+
+	form := endpoint.requests()[0]
+	for key, want := range map[string]string{
+		"grant_type":    "refresh_token",
+		"refresh_token": "refresh-1",
+		"client_id":     "client",
+		"client_secret": "secret",
+		"scope":         "mail.read offline_access",
+	} {
+		if got := form.Get(key); got != want {
+			t.Errorf("form %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// 服务器拒绝令牌后重新获取
+	invalidateToken(tokens)
+	mustToken(t, tokens, "access-2")
+	if n := len(endpoint.requests()); n != 2 {
+		t.Fatalf("token endpoint called %d times, want 2", n)
+	}
+}
+
+func TestRefreshTokenSourceRotatesRefreshToken(t *testing.T) {
+	// 没有 expires_in 时不缓存，每次都向令牌端点请求
+	tokens, endpoint := newRefreshTokenSource(t,
+		tokenEndpointResponse{http.StatusOK, `{"access_token":"access-1","refresh_token":"refresh-2"}`},
+		tokenEndpointResponse{http.StatusOK, `{"access_token":"access-2"}`},
+	)
+
+	mustToken(t, tokens, "access-1")
+	mustToken(t, tokens, "access-2")
+	mustToken(t, tokens, "access-2")
+
+	var got []string
+	for _, form := range endpoint.requests() {
+		got = append(got, form.Get("refresh_token"))
+	}
+	want := []string{"refresh-1", "refresh-2", "refresh-2"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("refresh tokens sent %v, want %v", got, want)
+	}
+}
+
+func TestRefreshTokenSourceErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		resp tokenEndpointResponse
+		want string
+	}{
+		{
+			"oauth2 error",
+			tokenEndpointResponse{http.StatusBadRequest, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`},
+			"status 400, invalid_grant: Token has been expired or revoked.",
+		},
+		{
+			"error with status 200",
+			tokenEndpointResponse{http.StatusOK, `{"error":"invalid_client"}`},
+			"status 200, invalid_client",
+		},
+		{
+			"not json",
+			tokenEndpointResponse{http.StatusBadGateway, `<html>Bad Gateway</html>`},
+			"status 502, invalid response",
+		},
+		{
+			"no access token",
+			tokenEndpointResponse{http.StatusOK, `{"expires_in":3600}`},
+			"response has no access_token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, _ := newRefreshTokenSource(t, tt.resp)
+			_, err := tokens.Token()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Token error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// parseXOAuth2 解析 XOAUTH2 的初始响应 user=...\x01auth=Bearer ...\x01\x01
+func parseXOAuth2(ir []byte) (user, token string, err error) {
+	for _, field := range strings.Split(strings.TrimRight(string(ir), "\x01"), "\x01") {
+		switch {
+		case strings.HasPrefix(field, "user="):
+			user = strings.TrimPrefix(field, "user=")
+		case strings.HasPrefix(field, "auth=Bearer "):
+			token = strings.TrimPrefix(field, "auth=Bearer ")
+		default:
+			return "", "", fmt.Errorf("invalid XOAUTH2 field %q", field)
+		}
+	}
+	return user, token, nil
+}
+
+// oauthBearerToken 从 OAUTHBEARER 的初始响应（RFC 7628）中取出令牌
+func oauthBearerToken(ir []byte) string {
+	for _, field := range strings.Split(string(ir), "\x01") {
+		if strings.HasPrefix(field, "auth=Bearer ") {
+			return strings.TrimPrefix(field, "auth=Bearer ")
+		}
+	}
+	return ""
+}
+
+const xoauth2Failure = `{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`
+
+// startPOP3Server 启动只处理 AUTH 和 QUIT 的 POP3 服务器，令牌为 good 时认证成功，
+// 失败时和 Gmail 一样先返回 JSON 错误质询，客户端取消后返回 -ERR。收到的初始响应写入 got
+func startPOP3Server(t *testing.T, got chan<- string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go servePOP3(conn, got)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func servePOP3(conn net.Conn, got chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "+OK ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "AUTH":
+			ir, _ := base64.StdEncoding.DecodeString(fields[2])
+			got <- fields[1] + " " + string(ir)
+
+			token := oauthBearerToken(ir)
+			if fields[1] == types.OAuth2MechanismXOAuth2 {
+				_, token, _ = parseXOAuth2(ir)
+			}
+			if token == "good" {
+				fmt.Fprint(conn, "+OK authenticated\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "+ %s\r\n", base64.StdEncoding.EncodeToString([]byte(xoauth2Failure)))
+			if line, _ := r.ReadString('\n'); strings.TrimSpace(line) == "*" {
+				fmt.Fprint(conn, "-ERR authentication cancelled\r\n")
+			}
+		case len(fields) == 1 && fields[0] == "QUIT":
+			fmt.Fprint(conn, "+OK bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func TestPOP3OAuth2Authenticate(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		token     string
+		want      string // 服务器收到的初始响应
+		wantErr   string
+	}{
+		{
+			mechanism: types.OAuth2MechanismXOAuth2,
+			token:     "good",
+			want:      "XOAUTH2 user=me@example.com\x01auth=Bearer good\x01\x01",
+		},
+		{
+			mechanism: types.OAuth2MechanismXOAuth2,
+			token:     "expired",
+			want:      "XOAUTH2 user=me@example.com\x01auth=Bearer expired\x01\x01",
+			wantErr:   xoauth2Failure,
+		},
+		{
+			mechanism: types.OAuth2MechanismOAuthBearer,
+			token:     "good",
+			want:      "OAUTHBEARER n,a=me@example.com,\x01host=127.0.0.1\x01port=",
+		},
+		{
+			mechanism: types.OAuth2MechanismOAuthBearer,
+			token:     "expired",
+			want:      "OAUTHBEARER n,a=me@example.com,\x01host=127.0.0.1\x01port=",
+			wantErr:   "401",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mechanism+" "+tt.token, func(t *testing.T) {
+			got := make(chan string, 1)
+			addr := startPOP3Server(t, got)
+			s, err := NewPOP3Source(&types.POP3Config{
+				Name:     "pop3",
+				Server:   addr,
+				Username: "me@example.com",
+				OAuth2:   &types.OAuth2Config{Mechanism: tt.mechanism, Token: tt.token},
+			}, &recordDispatcher{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.connect()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("connect: %v", err)
+				}
+				s.quit()
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("connect error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			ir := <-got
+			if !strings.HasPrefix(ir, tt.want) {
+				t.Fatalf("initial response = %q, want prefix %q", ir, tt.want)
+			}
+			if tt.mechanism == types.OAuth2MechanismOAuthBearer && oauthBearerToken([]byte(ir)) != tt.token {
+				t.Fatalf("initial response = %q, want token %q", ir, tt.token)
+			}
+		})
+	}
+}
+
+// xoauth2Server 是测试用的 XOAUTH2 服务端，令牌为 good 时认证成功，
+// 失败时返回 JSON 错误质询，等待客户端取消
+type xoauth2Server struct {
+	login  func(user string) error
+	failed bool
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.failed {
+		return nil, true, errors.New("XOAUTH2 authentication failed")
+	}
+	if response == nil {
+		// 客户端没有发送初始响应
+		return []byte{}, false, nil
+	}
+	user, token, err := parseXOAuth2(response)
+	if err != nil {
+		return nil, true, err
+	}
+	if token != "good" {
+		a.failed = true
+		return []byte(xoauth2Failure), false, nil
+	}
+	return nil, true, a.login(user)
+}
+
+// enableOAuth2 让 IMAP 服务器支持 XOAUTH2 和 OAUTHBEARER，令牌为 good 时以 username 登录
+func enableOAuth2(srv *server.Server, be *memory.Backend) {
+	login := func(conn server.Conn) error {
+		user, err := be.Login(conn.Info(), "username", "password")
+		if err != nil {
+			return err
+		}
+		ctx := conn.Context()
+		ctx.State = imap.AuthenticatedState
+		ctx.User = rfcUser{user}
+		return nil
+	}
+	srv.EnableAuth(types.OAuth2MechanismXOAuth2, func(conn server.Conn) sasl.Server {
+		return &xoauth2Server{login: func(user string) error {
+			if user != "me@example.com" {
+				return fmt.Errorf("unknown user %s", user)
+			}
+			return login(conn)
+		}}
+	})
+	srv.EnableAuth(sasl.OAuthBearer, func(conn server.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if opts.Username != "me@example.com" || opts.Token != "good" {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			if err := login(conn); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_request", Schemes: "bearer"}
+			}
+			return nil
+		})
+	})
+}
+
+func TestIMAPOAuth2Login(t *testing.T) {
+	addr := startIMAPServer(t, enableOAuth2)
+
+	for _, mechanism := range []string{types.OAuth2MechanismXOAuth2, types.OAuth2MechanismOAuthBearer} {
+		t.Run(mechanism, func(t *testing.T) {
+			config := &types.IMAPConfig{
+				Name:     "box",
+				Server:   addr,
+				Username: "me@example.com",
+				OAuth2:   &types.OAuth2Config{Mechanism: mechanism, Token: "good"},
+			}
+			d := &recordDispatcher{}
+			s := newTestIMAPSource(t, config, newTestStateStore(t), d)
+			checkInbox(t, s)
+			checkInbox(t, s)
+			assertIDs(t, d, "imap-1-6")
+		})
+	}
+}
+
+func TestIMAPOAuth2LoginRejected(t *testing.T) {
+	addr := startIMAPServer(t, enableOAuth2)
+
+	for _, mechanism := range []string{types.OAuth2MechanismXOAuth2, types.OAuth2MechanismOAuthBearer} {
+		t.Run(mechanism, func(t *testing.T) {
+			s, err := NewIMAPSource(&types.IMAPConfig{
+				Name:     "box",
+				Server:   addr,
+				Username: "me@example.com",
+				OAuth2:   &types.OAuth2Config{Mechanism: mechanism, Token: "expired"},
+			}, &recordDispatcher{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.connect()
+			if err == nil || !strings.Contains(err.Error(), "authenticate error") {
+				t.Fatalf("connect error = %v, want authenticate error", err)
+			}
+		})
+	}
+}
@@ -3,71 +3,117 @@ package sources
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
+	netmail "net/mail"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/emersion/go-sasl"
+
 	"github.com/iamlongalong/listenmail/pkg/types"
 	"github.com/iamlongalong/listenmail/pkg/utils"
 )
 
 // POP3Source implements a POP3 client as a mail source
 type POP3Source struct {
+	*health // 最近一次连接的状态，连接失败后按指数退避重新连接
+
 	config     *types.POP3Config
+	tokens     TokenSource // 配置了 oauth2 时提供登录用的访问令牌
 	conn       net.Conn
 	reader     *bufio.Reader
 	dispatcher types.Dispatcher
 	done       chan struct{}
+	wg         sync.WaitGroup // 等待 monitor 退出
+
+	state     *StateStore     // 持久化已处理的 UIDL，为 nil 时只保存在内存中
+	startFrom types.StartFrom // 首次同步的起点
 
 	mu            sync.RWMutex
+	loaded        bool                 // 已从数据库中读取 processedMsgs
+	synced        bool                 // 首次同步已完成
 	processedMsgs map[string]time.Time // 记录已处理的消息ID（使用UIDL）和处理时间
 }
 
 // NewPOP3Source creates a new POP3 source
 func NewPOP3Source(config *types.POP3Config, dispatcher types.Dispatcher) (*POP3Source, error) {
+	if config == nil {
+		config = &types.POP3Config{TLS: true}
+	}
+	config.SetDefaults()
+
+	startFrom, err := types.ParseStartFrom(config.StartFrom)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &POP3Source{
+		health:        newHealth(config.Name, types.SourceTypePOP3),
 		config:        config,
 		dispatcher:    dispatcher,
 		done:          make(chan struct{}),
+		startFrom:     startFrom,
 		processedMsgs: make(map[string]time.Time),
 	}
-
-	if config == nil {
-		config = &types.POP3Config{
-			TLS:      true,
-			Interval: 30 * time.Second,
+	if config.OAuth2 != nil {
+		if s.tokens, err = NewTokenSource(config.OAuth2); err != nil {
+			return nil, err
 		}
 	}
 
-	// 启动清理过期记录的goroutine
-	go s.cleanProcessedMsgs()
-
 	return s, nil
 }
 
-// cleanProcessedMsgs 定期清理超过24小时的记录
-func (s *POP3Source) cleanProcessedMsgs() {
-	ticker := time.NewTicker(1 * time.Hour)
-	defer ticker.Stop()
+// SetStateStore 设置保存同步进度的 StateStore，需要在 Start 之前调用
+func (s *POP3Source) SetStateStore(state *StateStore) {
+	s.state = state
+}
 
-	for {
-		select {
-		case <-s.done:
-			return
-		case <-ticker.C:
-			s.mu.Lock()
-			now := time.Now()
-			for id, t := range s.processedMsgs {
-				if now.Sub(t) > 24*time.Hour {
-					delete(s.processedMsgs, id)
-				}
-			}
-			s.mu.Unlock()
+// loadState 第一次检查时从数据库中读取已处理的 UIDL 和首次同步是否已完成
+func (s *POP3Source) loadState() error {
+	if s.loaded {
+		return nil
+	}
+	seen, err := s.state.Seen(s.Name())
+	if err != nil {
+		return fmt.Errorf("load sync state error: %v", err)
+	}
+	cursor, err := s.state.Cursor(s.Name(), "")
+	if err != nil {
+		return fmt.Errorf("load sync state error: %v", err)
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for id := range seen {
+		s.processedMsgs[id] = now
+	}
+	s.mu.Unlock()
+	s.loaded = true
+	s.synced = cursor != nil
+	return nil
+}
+
+// forgetDeleted 删除已不在服务器上的消息记录。消息留在服务器上时记录一直保留，
+// 否则过期后会被重新处理
+func (s *POP3Source) forgetDeleted(current map[string]bool) {
+	var deleted []string
+	s.mu.Lock()
+	for id := range s.processedMsgs {
+		if !current[id] {
+			deleted = append(deleted, id)
+			delete(s.processedMsgs, id)
 		}
 	}
+	s.mu.Unlock()
+
+	if err := s.state.Forget(s.Name(), deleted); err != nil {
+		log.Printf("pop3 source %s: save sync state error: %v", s.Name(), err)
+	}
 }
 
 // isProcessed 检查消息是否已处理过
@@ -78,11 +124,18 @@ func (s *POP3Source) isProcessed(id string) bool {
 	return exists
 }
 
-// markProcessed 标记消息为已处理
-func (s *POP3Source) markProcessed(id string) {
+// markProcessed 标记消息为已处理并保存到数据库
+func (s *POP3Source) markProcessed(ids ...string) {
 	s.mu.Lock()
-	s.processedMsgs[id] = time.Now()
+	now := time.Now()
+	for _, id := range ids {
+		s.processedMsgs[id] = now
+	}
 	s.mu.Unlock()
+
+	if err := s.state.MarkSeen(s.Name(), ids...); err != nil {
+		log.Printf("pop3 source %s: save sync state error: %v", s.Name(), err)
+	}
 }
 
 // Start implements Source interface
@@ -93,10 +146,20 @@ func (s *POP3Source) Start() error {
 	if s.config.Username == "" {
 		return fmt.Errorf("POP3 username is required")
 	}
-	if s.config.Password == "" {
-		return fmt.Errorf("POP3 password is required")
+	if s.config.Password == "" && s.tokens == nil {
+		return fmt.Errorf("POP3 password or oauth2 is required")
 	}
 
+	// Start monitoring for new messages, monitor connects in the background
+	log.Println("pop3 source is running...")
+	s.wg.Add(1)
+	go s.monitor()
+
+	return nil
+}
+
+// connect 连接服务器并登录，开始一个新的会话
+func (s *POP3Source) connect() error {
 	var err error
 	if s.config.TLS {
 		s.conn, err = tls.Dial("tcp", s.config.Server, &tls.Config{})
@@ -104,17 +167,40 @@ func (s *POP3Source) Start() error {
 		s.conn, err = net.Dial("tcp", s.config.Server)
 	}
 	if err != nil {
+		s.conn = nil
 		return fmt.Errorf("connect error: %v", err)
 	}
 
 	s.reader = bufio.NewReader(s.conn)
 
+	if err := s.login(); err != nil {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+		return err
+	}
+	s.connected()
+	return nil
+}
+
+func (s *POP3Source) login() error {
 	// Read greeting
-	_, err = s.readResponse()
+	_, err := s.readResponse()
 	if err != nil {
 		return fmt.Errorf("read greeting error: %v", err)
 	}
 
+	if s.tokens != nil {
+		auth, err := newOAuth2Client(s.config.OAuth2, s.tokens, s.config.Username, s.config.Server)
+		if err != nil {
+			return fmt.Errorf("oauth2 token error: %v", err)
+		}
+		if err := s.authenticate(auth); err != nil {
+			invalidateToken(s.tokens)
+			return fmt.Errorf("auth command error: %v", err)
+		}
+		return nil
+	}
+
 	// Login
 	if _, err = s.sendCommand(fmt.Sprintf("USER %s", s.config.Username)); err != nil {
 		return fmt.Errorf("user command error: %v", err)
@@ -123,22 +209,75 @@ func (s *POP3Source) Start() error {
 	if _, err = s.sendCommand(fmt.Sprintf("PASS %s", s.config.Password)); err != nil {
 		return fmt.Errorf("pass command error: %v", err)
 	}
+	return nil
+}
 
-	// Start monitoring for new messages
-	log.Println("pop3 source is running...")
-	go s.monitor()
+// authenticate 执行 SASL 认证（RFC 5034），初始响应直接跟在 AUTH 命令后面
+func (s *POP3Source) authenticate(auth sasl.Client) error {
+	mech, ir, err := auth.Start()
+	if err != nil {
+		return err
+	}
+	cmd := "AUTH " + mech
+	if ir != nil {
+		resp := base64.StdEncoding.EncodeToString(ir)
+		if resp == "" {
+			resp = "="
+		}
+		cmd += " " + resp
+	}
+	if _, err := fmt.Fprintf(s.conn, "%s\r\n", cmd); err != nil {
+		return err
+	}
 
-	return nil
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "+OK") {
+			return nil
+		}
+		if !strings.HasPrefix(line, "+") {
+			return fmt.Errorf("server error: %s", line)
+		}
+
+		// 服务器的质询，认证失败时 XOAUTH2 和 OAUTHBEARER 在这里返回错误详情
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "+")))
+		if err != nil {
+			return fmt.Errorf("invalid challenge %q: %v", line, err)
+		}
+		resp, err := auth.Next(challenge)
+		if err != nil {
+			// 取消认证，服务器随后返回 -ERR
+			if _, werr := fmt.Fprintf(s.conn, "*\r\n"); werr == nil {
+				s.reader.ReadString('\n')
+			}
+			return err
+		}
+		if _, err := fmt.Fprintf(s.conn, "%s\r\n", base64.StdEncoding.EncodeToString(resp)); err != nil {
+			return err
+		}
+	}
+}
+
+// quit 结束当前会话，服务器在 QUIT 之后才提交会话中的改动
+func (s *POP3Source) quit() {
+	if s.conn == nil {
+		return
+	}
+	s.sendCommand("QUIT")
+	s.conn.Close()
+	s.conn, s.reader = nil, nil
 }
 
 // Stop implements Source interface
 func (s *POP3Source) Stop() error {
 	log.Println("pop3 source is stopping...")
 	close(s.done)
-	if s.conn != nil {
-		s.sendCommand("QUIT")
-		s.conn.Close()
-	}
+	s.wg.Wait() // 等待正在进行的检查完成
+	s.quit()
 	return nil
 }
 
@@ -148,6 +287,13 @@ func (s *POP3Source) Name() string {
 }
 
 func (s *POP3Source) monitor() {
+	defer s.wg.Done()
+
+	// 启动时登录一次，这个会话用于第一次检查，失败时按退避重试
+	if !s.connectFirst(s.done, s.connect) {
+		return
+	}
+
 	ticker := time.NewTicker(s.config.Interval)
 	defer ticker.Stop()
 
@@ -156,15 +302,35 @@ func (s *POP3Source) monitor() {
 		case <-s.done:
 			return
 		case <-ticker.C:
-			if err := s.checkNewMessages(); err != nil {
-				// log error but continue monitoring
-				continue
+		}
+
+		// POP3 会话期间邮箱内容保持不变，每次检查都重新登录才能看到新邮件
+		if s.conn == nil {
+			if err := s.connect(); err != nil {
+				s.disconnected(err)
+				log.Printf("pop3 source %s: %v, reconnecting", s.Name(), err)
+				if !s.reconnect(s.done, s.connect) {
+					return
+				}
 			}
 		}
+
+		err := s.checkNewMessages()
+		s.quit()
+		if err != nil {
+			s.failed(err)
+			log.Printf("pop3 source %s: check new messages error: %v", s.Name(), err)
+			continue
+		}
+		s.polled()
 	}
 }
 
 func (s *POP3Source) checkNewMessages() error {
+	if err := s.loadState(); err != nil {
+		return err
+	}
+
 	// 获取消息列表
 	_, err := s.sendCommand("UIDL")
 	if err != nil {
@@ -197,6 +363,38 @@ func (s *POP3Source) checkNewMessages() error {
 		}{num, id})
 	}
 
+	current := make(map[string]bool, len(uidlList))
+	for _, msg := range uidlList {
+		current[msg.ID] = true
+	}
+	s.forgetDeleted(current)
+
+	// 首次同步按 start_from 把要跳过的已有邮件标记为已处理
+	if !s.synced {
+		var skip []string
+		for _, msg := range uidlList {
+			if s.isProcessed(msg.ID) {
+				continue
+			}
+			if s.startFrom.Now {
+				skip = append(skip, msg.ID)
+			} else if !s.startFrom.Since.IsZero() {
+				date, err := s.messageDate(msg.Number)
+				if err != nil {
+					return err
+				}
+				if !date.IsZero() && date.Before(s.startFrom.Since) {
+					skip = append(skip, msg.ID)
+				}
+			}
+		}
+		s.markProcessed(skip...)
+		if err := s.state.SaveCursor(s.Name(), "", 0, 0); err != nil {
+			return fmt.Errorf("save sync state error: %v", err)
+		}
+		s.synced = true
+	}
+
 	// 处理每个未处理的消息
 	for _, msg := range uidlList {
 		// 检查消息是否已处理
@@ -232,9 +430,17 @@ func (s *POP3Source) checkNewMessages() error {
 		// 设置唯一ID
 		mail.ID = fmt.Sprintf("pop3-%s", msg.ID)
 		mail.Source = s.Name()
+		mail.Envelope = utils.EnvelopeFromHeaders(mail)
+		mail.Envelope.RemoteAddr = s.config.Server
+		mail.Envelope.TLS = s.config.TLS
+		mail.Envelope.ReceivedAt = time.Now()
 
 		if err := s.dispatcher.Dispatch(mail); err != nil {
-			return err
+			if !types.IsPermanent(err) {
+				return err
+			}
+			// 处理器明确拒绝的邮件不再重试
+			log.Printf("pop3 source %s: mail %s rejected: %v", s.Name(), mail.ID, err)
 		}
 
 		// 标记消息为已处理
@@ -244,6 +450,34 @@ func (s *POP3Source) checkNewMessages() error {
 	return nil
 }
 
+// messageDate 用 TOP 命令读取消息头中的 Date，没有或无法解析时返回零值
+func (s *POP3Source) messageDate(number int) (time.Time, error) {
+	if _, err := s.sendCommand(fmt.Sprintf("TOP %d 0", number)); err != nil {
+		return time.Time{}, err
+	}
+	var header strings.Builder
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return time.Time{}, err
+		}
+		if line == ".\r\n" {
+			break
+		}
+		header.WriteString(strings.TrimPrefix(line, "."))
+	}
+
+	msg, err := netmail.ReadMessage(strings.NewReader(header.String() + "\r\n"))
+	if err != nil {
+		return time.Time{}, nil
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		return time.Time{}, nil
+	}
+	return date, nil
+}
+
 func (s *POP3Source) sendCommand(cmd string) (string, error) {
 	_, err := fmt.Fprintf(s.conn, "%s\r\n", cmd)
 	if err != nil {
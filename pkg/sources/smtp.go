@@ -2,12 +2,20 @@ package sources
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
 	"github.com/iamlongalong/listenmail/pkg/types"
 	"github.com/iamlongalong/listenmail/pkg/utils"
 )
@@ -21,26 +29,36 @@ type SMTPSource struct {
 
 // NewSMTPSource creates a new SMTP source
 func NewSMTPSource(config *types.SMTPConfig, dispatcher types.Dispatcher) (*SMTPSource, error) {
+	if config == nil {
+		config = &types.SMTPConfig{AllowInsecureAuth: true}
+	}
+	config.SetDefaults()
+
 	s := &SMTPSource{
 		config:     config,
 		dispatcher: dispatcher,
 	}
 
-	if config == nil {
-		config = &types.SMTPConfig{
-			Address:           ":25",
-			Domain:            "localhost",
-			ReadTimeout:       10 * time.Second,
-			WriteTimeout:      10 * time.Second,
-			MaxMessageBytes:   10 * 1024 * 1024, // 10MB
-			MaxRecipients:     50,
-			AllowInsecureAuth: true,
-		}
+	users, err := loadUserStore(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.RequireAuth && users.empty() {
+		return nil, fmt.Errorf("smtp source %s requires auth but has no users configured", config.Name)
+	}
+
+	recipients, err := newRecipientFilter(config.AcceptedDomains, config.AcceptedRecipients)
+	if err != nil {
+		return nil, err
 	}
 
 	backend := &Backend{
-		sourceName: s.Name(),
-		dispatcher: dispatcher,
+		sourceName:  s.Name(),
+		dispatcher:  dispatcher,
+		users:       users,
+		requireAuth: config.RequireAuth,
+		requireTLS:  config.RequireTLS,
+		recipients:  recipients,
 	}
 
 	s.server = smtp.NewServer(backend)
@@ -52,14 +70,45 @@ func NewSMTPSource(config *types.SMTPConfig, dispatcher types.Dispatcher) (*SMTP
 	s.server.MaxRecipients = config.MaxRecipients
 	s.server.AllowInsecureAuth = config.AllowInsecureAuth
 
+	if config.TLSCert != "" || config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("load tls certificate error: %v", err)
+		}
+		s.server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	if (config.ImplicitTLS || config.RequireTLS) && s.server.TLSConfig == nil {
+		return nil, fmt.Errorf("smtp source %s: implicit_tls and require_tls need tls_cert and tls_key", config.Name)
+	}
+
 	return s, nil
 }
 
 // Start implements Source interface
+// 监听失败（如端口被占用）时返回错误，重新加载配置时不会导致进程退出
 func (s *SMTPSource) Start() error {
+	addr := s.server.Addr
+	if addr == "" && s.config.ImplicitTLS {
+		addr = ":smtps"
+	} else if addr == "" {
+		addr = ":smtp"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen %s error: %v", addr, err)
+	}
+	if s.config.ImplicitTLS {
+		l = tls.NewListener(l, s.server.TLSConfig)
+	}
+
 	log.Println("smtp source is running...")
 	go func() {
-		log.Fatal(s.server.ListenAndServe())
+		if err := s.server.Serve(l); err != nil && err != smtp.ErrServerClosed {
+			log.Printf("smtp source %s serve error: %v", s.config.Name, err)
+		}
 	}()
 	return nil
 }
@@ -70,21 +119,86 @@ func (s *SMTPSource) Stop() error {
 	return s.server.Close()
 }
 
+// Shutdown 停止接收新连接，等待正在进行的会话结束或 ctx 到期
+func (s *SMTPSource) Shutdown(ctx context.Context) error {
+	log.Println("smtp source is shutting down...")
+	err := s.server.Shutdown(ctx)
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		s.server.Close()
+	}
+	return err
+}
+
 // Name implements Source interface
 func (s *SMTPSource) Name() string {
 	return s.config.Name
 }
 
+// errInvalidCredentials 账号或密码错误时返回给客户端
+var errInvalidCredentials = &smtp.SMTPError{
+	Code:         535,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+	Message:      "Authentication credentials invalid",
+}
+
+// errTLSRequired 要求 TLS 但客户端未执行 STARTTLS 时返回给客户端
+var errTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+// errMalformedMessage 邮件无法解析时返回给客户端
+var errMalformedMessage = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Malformed message",
+}
+
+// errTemporaryFailure 处理器临时失败时返回给客户端，发件方会稍后重试
+var errTemporaryFailure = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Requested action aborted: local error in processing",
+}
+
+// errQueueFull 队列已满且策略为 reject 时返回给客户端，发件方会稍后重试
+var errQueueFull = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Queue is full, try again later",
+}
+
+// errMessageRejected 处理器明确拒收时返回给客户端，错误详情只写入日志
+var errMessageRejected = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected",
+}
+
+// errUnknownRecipient 收件人不在允许列表中时返回给客户端
+var errUnknownRecipient = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Recipient address rejected: user unknown",
+}
+
 // Backend implements SMTP server methods
 type Backend struct {
-	sourceName string
-	dispatcher types.Dispatcher
+	sourceName  string
+	dispatcher  types.Dispatcher
+	users       *userStore
+	requireAuth bool
+	requireTLS  bool
+	recipients  *recipientFilter
 }
 
-func (bkd *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	return &Session{
 		sourceName: bkd.sourceName,
 		dispatcher: bkd.dispatcher,
+		backend:    bkd,
+		conn:       c,
 	}, nil
 }
 
@@ -92,20 +206,59 @@ func (bkd *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
 type Session struct {
 	sourceName string
 	dispatcher types.Dispatcher
+	backend    *Backend
+	conn       *smtp.Conn
 	from       string
 	to         []string
+
+	authenticated bool
+	username      string
 }
 
-func (s *Session) AuthPlain(username, password string) error {
-	return nil
+// AuthMechanisms implements smtp.AuthSession
+func (s *Session) AuthMechanisms() []string {
+	// 没有配置账号时不提供 AUTH
+	if s.backend.users.empty() {
+		return nil
+	}
+	return []string{sasl.Plain}
+}
+
+// Auth implements smtp.AuthSession
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if mech != sasl.Plain || s.backend.users.empty() {
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return errInvalidCredentials
+		}
+		if !s.backend.users.authenticate(username, password) {
+			log.Printf("smtp source %s: authentication failed for %q", s.sourceName, username)
+			return errInvalidCredentials
+		}
+		s.authenticated = true
+		s.username = username
+		return nil
+	}), nil
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if _, isTLS := s.conn.TLSConnectionState(); s.backend.requireTLS && !isTLS {
+		return errTLSRequired
+	}
+	if s.backend.requireAuth && !s.authenticated {
+		return smtp.ErrAuthRequired
+	}
 	s.from = from
 	return nil
 }
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if !s.backend.recipients.accept(to) {
+		log.Printf("smtp source %s: rejected recipient %q", s.sourceName, to)
+		return errUnknownRecipient
+	}
 	s.to = append(s.to, to)
 	return nil
 }
@@ -120,7 +273,8 @@ func (s *Session) Data(r io.Reader) error {
 	// 解析邮件
 	mail, err := utils.ParseMail(buf)
 	if err != nil {
-		return err
+		log.Printf("smtp source %s: parse mail error: %v", s.sourceName, err)
+		return errMalformedMessage
 	}
 	if mail.ID == "" {
 		mail.ID = mail.MessageID
@@ -129,9 +283,36 @@ func (s *Session) Data(r io.Reader) error {
 		mail.ID = fmt.Sprintf("%s:%s:%s", mail.Date, mail.From[0].String(), mail.To[0].String())
 	}
 	mail.Source = s.sourceName
+	mail.Envelope = s.envelope()
 
-	// 分发邮件
-	return s.dispatcher.Dispatch(mail)
+	// 分发邮件，只有全部处理成功才返回 250。
+	// 处理器的错误可能包含内部路径、URL 或 webhook 响应，不返回给客户端
+	if err := s.dispatcher.Dispatch(mail); err != nil {
+		log.Printf("smtp source %s: dispatch mail %s error: %v", s.sourceName, mail.ID, err)
+		if types.IsPermanent(err) {
+			return errMessageRejected
+		}
+		if errors.Is(err, dispatcher.ErrQueueFull) {
+			return errQueueFull
+		}
+		return errTemporaryFailure
+	}
+	return nil
+}
+
+// envelope 根据当前会话构造信封信息
+func (s *Session) envelope() types.Envelope {
+	env := types.Envelope{
+		From:       s.from,
+		To:         append([]string(nil), s.to...),
+		Helo:       s.conn.Hostname(),
+		ReceivedAt: time.Now(),
+	}
+	if c := s.conn.Conn(); c != nil {
+		env.RemoteAddr = c.RemoteAddr().String()
+	}
+	_, env.TLS = s.conn.TLSConnectionState()
+	return env
 }
 
 func (s *Session) Reset() {
@@ -142,3 +323,55 @@ func (s *Session) Reset() {
 func (s *Session) Logout() error {
 	return nil
 }
+
+// recipientFilter 根据域名和地址白名单过滤 RCPT TO
+type recipientFilter struct {
+	domains    []string
+	recipients []string
+}
+
+// newRecipientFilter 创建收件人过滤器，模式统一转为小写并校验通配符语法
+func newRecipientFilter(domains, recipients []string) (*recipientFilter, error) {
+	f := &recipientFilter{}
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if _, err := path.Match(d, ""); err != nil {
+			return nil, fmt.Errorf("invalid accepted domain %q: %v", d, err)
+		}
+		f.domains = append(f.domains, d)
+	}
+	for _, r := range recipients {
+		r = strings.ToLower(strings.TrimSpace(r))
+		if _, err := path.Match(r, ""); err != nil {
+			return nil, fmt.Errorf("invalid accepted recipient %q: %v", r, err)
+		}
+		f.recipients = append(f.recipients, r)
+	}
+	return f, nil
+}
+
+// accept 判断收件人是否允许接收
+func (f *recipientFilter) accept(rcpt string) bool {
+	if len(f.domains) == 0 && len(f.recipients) == 0 {
+		return true
+	}
+
+	rcpt = strings.ToLower(rcpt)
+	for _, pattern := range f.recipients {
+		if ok, _ := path.Match(pattern, rcpt); ok {
+			return true
+		}
+	}
+
+	at := strings.LastIndex(rcpt, "@")
+	if at < 0 {
+		return false
+	}
+	domain := rcpt[at+1:]
+	for _, pattern := range f.domains {
+		if ok, _ := path.Match(pattern, domain); ok {
+			return true
+		}
+	}
+	return false
+}
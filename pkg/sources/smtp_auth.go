@@ -0,0 +1,101 @@
+package sources
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// userStore 保存 SMTP AUTH 允许登录的账号
+type userStore struct {
+	users map[string]string // username -> 明文密码或哈希
+}
+
+// loadUserStore 从配置中的 users 和 users_file 加载账号
+func loadUserStore(config *types.SMTPConfig) (*userStore, error) {
+	u := &userStore{
+		users: make(map[string]string),
+	}
+
+	for _, user := range config.Users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("smtp user with empty username")
+		}
+		u.users[user.Username] = user.Password
+	}
+
+	if config.UsersFile != "" {
+		if err := u.loadFile(config.UsersFile); err != nil {
+			return nil, fmt.Errorf("load users file error: %v", err)
+		}
+	}
+
+	return u, nil
+}
+
+// loadFile 读取 htpasswd 格式的文件，每行一个 user:password
+func (u *userStore) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("%s:%d: expected user:password", path, lineNum)
+		}
+		if strings.HasPrefix(password, "$apr1$") {
+			return fmt.Errorf("%s:%d: apr1 (MD5) hashes are not supported, use bcrypt (htpasswd -B)", path, lineNum)
+		}
+		u.users[username] = password
+	}
+
+	return scanner.Err()
+}
+
+// empty 是否没有配置任何账号
+func (u *userStore) empty() bool {
+	return len(u.users) == 0
+}
+
+// authenticate 校验用户名和密码
+func (u *userStore) authenticate(username, password string) bool {
+	stored, ok := u.users[username]
+	if !ok {
+		return false
+	}
+
+	switch {
+	case isBcryptHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := strings.TrimPrefix(stored, "{SHA}")
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(expected)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+// isBcryptHash 判断字符串是否为 bcrypt 哈希
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
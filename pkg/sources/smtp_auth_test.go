@@ -0,0 +1,83 @@
+package sources
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+func TestUserStoreAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("secret"))
+
+	file := filepath.Join(t.TempDir(), "users")
+	content := "# comment\n\n" +
+		"bcrypt:" + string(hash) + "\n" +
+		"sha:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n" +
+		"filed:secret\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := loadUserStore(&types.SMTPConfig{
+		Users:     []types.SMTPUser{{Username: "plain", Password: "secret"}},
+		UsersFile: file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username, password string
+		want               bool
+	}{
+		{"plain", "secret", true},
+		{"plain", "Secret", false},
+		{"bcrypt", "secret", true},
+		{"bcrypt", "wrong", false},
+		{"sha", "secret", true},
+		{"sha", "wrong", false},
+		{"filed", "secret", true},
+		{"unknown", "secret", false},
+		{"plain", "", false},
+	}
+	for _, tt := range tests {
+		if got := users.authenticate(tt.username, tt.password); got != tt.want {
+			t.Errorf("authenticate(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestUserStoreRejectsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"apr1", "user:$apr1$abc$def\n", "apr1 (MD5) hashes are not supported"},
+		{"missing password", "# users\nuser\n", ":2: expected user:password"},
+		{"empty username", ":secret\n", ":1: expected user:password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "users")
+			if err := os.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadUserStore(&types.SMTPConfig{UsersFile: file})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package sources
+
+import "testing"
+
+func TestRecipientFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		domains    []string
+		recipients []string
+		rcpt       string
+		want       bool
+	}{
+		{"no allowlist", nil, nil, "anyone@anywhere.com", true},
+		{"domain", []string{"example.com"}, nil, "user@example.com", true},
+		{"domain is case insensitive", []string{"Example.COM"}, nil, "User@EXAMPLE.com", true},
+		{"other domain", []string{"example.com"}, nil, "user@example.org", false},
+		{"subdomain needs a wildcard", []string{"example.com"}, nil, "user@mail.example.com", false},
+		{"domain wildcard", []string{"*.example.com"}, nil, "user@mail.example.com", true},
+		{"domain wildcard does not match the parent", []string{"*.example.com"}, nil, "user@example.com", false},
+		{"no domain in address", []string{"example.com"}, nil, "postmaster", false},
+		{"recipient", nil, []string{"alerts@example.com"}, "alerts@example.com", true},
+		{"other recipient", nil, []string{"alerts@example.com"}, "ops@example.com", false},
+		{"recipient wildcard", nil, []string{"alerts+*@example.com"}, "alerts+prod@example.com", true},
+		{"recipient character class", nil, []string{"ops-[0-9]@example.com"}, "ops-7@example.com", true},
+		{"either list", []string{"example.org"}, []string{"alerts@example.com"}, "user@example.org", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newRecipientFilter(tt.domains, tt.recipients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.accept(tt.rcpt); got != tt.want {
+				t.Errorf("accept(%q) = %v, want %v", tt.rcpt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecipientFilterInvalidPattern(t *testing.T) {
+	if _, err := newRecipientFilter([]string{"[example.com"}, nil); err == nil {
+		t.Error("invalid domain pattern accepted")
+	}
+	if _, err := newRecipientFilter(nil, []string{"user@[example.com"}); err == nil {
+		t.Error("invalid recipient pattern accepted")
+	}
+}
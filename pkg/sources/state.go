@@ -0,0 +1,122 @@
+package sources
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
+)
+
+// StateStore 持久化 IMAP、POP3 和 MailHog 源的同步进度，重启后从上次的位置继续。
+// 为 nil 时所有方法都不做任何事，进度只保存在内存中
+type StateStore struct {
+	db *gorm.DB
+}
+
+// NewStateStore 创建一个新的 StateStore
+func NewStateStore(dbPath string) (*StateStore, error) {
+	db, err := utils.OpenDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("open database error: %v", err)
+	}
+
+	if err := db.AutoMigrate(&types.DBSyncCursor{}, &types.DBSyncSeen{}); err != nil {
+		return nil, fmt.Errorf("auto migrate error: %v", err)
+	}
+
+	return &StateStore{db: db}, nil
+}
+
+// Close 关闭数据库连接
+func (s *StateStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Cursor 返回源（和文件夹）的同步进度，没有记录时返回 nil
+func (s *StateStore) Cursor(source, folder string) (*types.DBSyncCursor, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var cursors []types.DBSyncCursor
+	if err := s.db.Where("source = ? AND folder = ?", source, folder).Limit(1).Find(&cursors).Error; err != nil {
+		return nil, err
+	}
+	if len(cursors) == 0 {
+		return nil, nil
+	}
+	return &cursors[0], nil
+}
+
+// SaveCursor 写入源（和文件夹）的同步进度
+func (s *StateStore) SaveCursor(source, folder string, uidValidity, lastUID uint32) error {
+	if s == nil {
+		return nil
+	}
+	cursor := &types.DBSyncCursor{
+		Source:      source,
+		Folder:      folder,
+		UIDValidity: uidValidity,
+		LastUID:     lastUID,
+	}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "source"}, {Name: "folder"}},
+		DoUpdates: clause.AssignmentColumns([]string{"uid_validity", "last_uid", "updated_at"}),
+	}).Create(cursor).Error
+}
+
+// Seen 返回源已处理过的消息 ID
+func (s *StateStore) Seen(source string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	if s == nil {
+		return seen, nil
+	}
+	var ids []string
+	if err := s.db.Model(&types.DBSyncSeen{}).Where("source = ?", source).Pluck("message_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		seen[id] = true
+	}
+	return seen, nil
+}
+
+// MarkSeen 记录已处理的消息 ID，已存在的记录保持不变
+func (s *StateStore) MarkSeen(source string, ids ...string) error {
+	if s == nil || len(ids) == 0 {
+		return nil
+	}
+	records := make([]*types.DBSyncSeen, len(ids))
+	for i, id := range ids {
+		records[i] = &types.DBSyncSeen{Source: source, MessageID: id}
+	}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(records, 500).Error
+}
+
+// Forget 删除已不在服务器上的消息 ID
+func (s *StateStore) Forget(source string, ids []string) error {
+	if s == nil {
+		return nil
+	}
+	// 分批删除，避免超过 SQLite 的参数数量限制
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > 500 {
+			n = 500
+		}
+		if err := s.db.Where("source = ? AND message_id IN ?", source, ids[:n]).Delete(&types.DBSyncSeen{}).Error; err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
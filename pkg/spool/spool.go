@@ -0,0 +1,635 @@
+package spool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
+	"github.com/iamlongalong/listenmail/pkg/types"
+	"github.com/iamlongalong/listenmail/pkg/utils"
+)
+
+const (
+	rawExt    = ".eml"
+	metaExt   = ".json"
+	failedDir = "failed"
+
+	// queueFullDelay 是 Dispatcher 队列满时再次投递前的等待时间
+	queueFullDelay = time.Second
+)
+
+// Spool 是邮件源和 Dispatcher 之间的磁盘队列
+// 邮件先落盘（.eml 原文 + .json 元数据）再返回，由 worker 异步投递给 Dispatcher，
+// 失败后按指数退避重试，进程重启后会继续投递未完成的邮件。
+// 队列中的邮件达到上限后按 QueueFullPolicy 等待或拒绝新邮件
+type Spool struct {
+	dir  string
+	next types.Dispatcher
+
+	workers      int
+	maxAttempts  int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	queueSize    int // 队列中最多的邮件数量，0 表示不限制
+	queueFull    dispatcher.QueueFullPolicy
+
+	mu       sync.Mutex
+	items    map[string]*item // 队列中的邮件，启动时从磁盘读取一次，之后只在内存中维护
+	reserved int              // 已通过 admit 正在落盘的邮件
+	freed    chan struct{}    // 有邮件离开队列时关闭并替换，唤醒等待空位的 Dispatch
+	inflight map[string]bool
+
+	jobs      chan string
+	notify    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// item 是队列中一封邮件的调度信息
+type item struct {
+	createdAt   time.Time
+	nextAttempt time.Time
+}
+
+// entry 是落盘的元数据
+type entry struct {
+	ID          string         `json:"id"`
+	MailID      string         `json:"mail_id"`
+	Source      string         `json:"source"`
+	Envelope    types.Envelope `json:"envelope"`
+	Attempts    int            `json:"attempts"`
+	NextAttempt time.Time      `json:"next_attempt"`
+	LastError   string         `json:"last_error,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// Option configures a Spool
+type Option func(*Spool)
+
+// WithWorkers 设置同时投递的邮件数量，serve 中与 dispatcher.workers 相同
+func WithWorkers(n int) Option {
+	return func(s *Spool) {
+		if n > 0 {
+			s.workers = n
+		}
+	}
+}
+
+// WithQueueLimit 设置队列中最多的邮件数量和达到上限时的策略：
+// block 等待空位，reject 返回 dispatcher.ErrQueueFull，spill 不限制数量全部写入磁盘
+func WithQueueLimit(n int, policy dispatcher.QueueFullPolicy) Option {
+	return func(s *Spool) {
+		if n > 0 {
+			s.queueSize = n
+		}
+		s.queueFull = policy
+	}
+}
+
+// New creates a new Spool that delivers mails to next
+func New(config types.SpoolConfig, next types.Dispatcher, opts ...Option) (*Spool, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("spool directory is required")
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 10
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 30 * time.Second
+	}
+
+	if err := os.MkdirAll(filepath.Join(config.Dir, failedDir), 0755); err != nil {
+		return nil, fmt.Errorf("create spool directory error: %v", err)
+	}
+
+	s := &Spool{
+		dir:          config.Dir,
+		next:         next,
+		workers:      10, // 与 Dispatcher 的默认 worker 数量相同
+		maxAttempts:  config.MaxAttempts,
+		retryBackoff: config.RetryBackoff,
+		maxBackoff:   time.Hour,
+		queueSize:    100, // 与 Dispatcher 的默认队列长度相同
+		queueFull:    dispatcher.QueueFullBlock,
+		items:        make(map[string]*item),
+		freed:        make(chan struct{}),
+		inflight:     make(map[string]bool),
+		jobs:         make(chan string),
+		notify:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.queueFull == dispatcher.QueueFullSpill {
+		s.queueSize = 0
+	}
+
+	if err := s.cleanOrphans(); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+// Dispatch implements types.Dispatcher，邮件落盘后即返回
+func (s *Spool) Dispatch(mail *types.Mail) error {
+	// 没有原文的邮件无法落盘，直接投递
+	if len(mail.Raw) == 0 {
+		return s.next.Dispatch(mail)
+	}
+
+	if err := s.admit(); err != nil {
+		return err
+	}
+	e, err := s.write(mail)
+
+	s.mu.Lock()
+	s.reserved--
+	if err == nil {
+		s.items[e.ID] = &item{createdAt: e.CreatedAt, nextAttempt: e.NextAttempt}
+	} else {
+		s.signalFreed()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.wake()
+	return nil
+}
+
+// admit 为新邮件预留队列中的位置，队列已满时按策略等待或返回 ErrQueueFull
+func (s *Spool) admit() error {
+	for {
+		s.mu.Lock()
+		if s.queueSize <= 0 || len(s.items)+s.reserved < s.queueSize {
+			s.reserved++
+			s.mu.Unlock()
+			return nil
+		}
+		freed := s.freed
+		s.mu.Unlock()
+
+		if s.queueFull == dispatcher.QueueFullReject {
+			return dispatcher.ErrQueueFull
+		}
+		select {
+		case <-freed:
+		case <-s.done:
+			return dispatcher.ErrClosed
+		}
+	}
+}
+
+// signalFreed 唤醒等待空位的 Dispatch，调用时需持有 s.mu
+func (s *Spool) signalFreed() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+// write 把邮件原文和元数据写入磁盘
+func (s *Spool) write(mail *types.Mail) (*entry, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, fmt.Errorf("spool write error: %v", err)
+	}
+	e := &entry{
+		ID:        id,
+		MailID:    mail.ID,
+		Source:    mail.Source,
+		Envelope:  mail.Envelope,
+		CreatedAt: time.Now(),
+	}
+	e.NextAttempt = e.CreatedAt
+
+	// 先写原文，再写元数据，元数据存在即表示落盘完成
+	if err := writeFileSync(s.path(e.ID, rawExt), mail.Raw); err != nil {
+		os.Remove(s.path(e.ID, rawExt))
+		return nil, fmt.Errorf("spool write error: %v", err)
+	}
+	if err := s.writeMeta(e); err != nil {
+		os.Remove(s.path(e.ID, rawExt))
+		return nil, fmt.Errorf("spool write error: %v", err)
+	}
+	return e, nil
+}
+
+// AddHandlers implements types.Dispatcher
+func (s *Spool) AddHandlers(handlers ...types.Handler) error {
+	return s.next.AddHandlers(handlers...)
+}
+
+// RemoveHandlers implements types.Dispatcher
+func (s *Spool) RemoveHandlers(handlers ...types.Handler) error {
+	return s.next.RemoveHandlers(handlers...)
+}
+
+// Shutdown 停止投递新的邮件，等待正在投递的邮件完成或 ctx 到期，
+// 未完成的邮件留在磁盘上，下次启动继续
+func (s *Spool) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close 停止投递并等待正在投递的邮件完成
+func (s *Spool) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+// closing 是否已经开始关闭
+func (s *Spool) closing() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wake 通知调度循环有新邮件
+func (s *Spool) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run 把到期的邮件交给 worker，然后等待新邮件或下一封邮件到期
+func (s *Spool) run() {
+	defer s.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		next, ok := s.schedule()
+		if !ok {
+			return
+		}
+
+		// 没有等待重试的邮件时只等新邮件的通知
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(next))
+			wait = timer.C
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-wait:
+		case <-s.notify:
+		}
+	}
+}
+
+// schedule 按接收顺序把到期的邮件交给 worker，返回下一封邮件的到期时间（没有时为零值），
+// 开始关闭时返回 false
+func (s *Spool) schedule() (time.Time, bool) {
+	var due []string
+	var next time.Time
+
+	now := time.Now()
+	s.mu.Lock()
+	for id, it := range s.items {
+		if s.inflight[id] {
+			continue
+		}
+		if it.nextAttempt.After(now) {
+			if next.IsZero() || it.nextAttempt.Before(next) {
+				next = it.nextAttempt
+			}
+			continue
+		}
+		due = append(due, id)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		a, b := s.items[due[i]], s.items[due[j]]
+		if !a.createdAt.Equal(b.createdAt) {
+			return a.createdAt.Before(b.createdAt)
+		}
+		return due[i] < due[j]
+	})
+	for _, id := range due {
+		s.inflight[id] = true
+	}
+	s.mu.Unlock()
+
+	for i, id := range due {
+		select {
+		case s.jobs <- id:
+		case <-s.done:
+			for _, id := range due[i:] {
+				s.release(id)
+			}
+			return next, false
+		}
+	}
+	return next, true
+}
+
+// retryAt 更新邮件的下次投递时间
+func (s *Spool) retryAt(id string, t time.Time) {
+	s.mu.Lock()
+	if it := s.items[id]; it != nil {
+		it.nextAttempt = t
+	}
+	s.mu.Unlock()
+}
+
+// forget 把邮件移出队列
+func (s *Spool) forget(id string) {
+	s.mu.Lock()
+	delete(s.items, id)
+	s.signalFreed()
+	s.mu.Unlock()
+}
+
+// worker 投递邮件给下游 Dispatcher
+func (s *Spool) worker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case id := <-s.jobs:
+			s.deliver(id)
+			s.release(id)
+			// 调度循环跳过了投递中的邮件，需要重新计算下次到期时间
+			s.wake()
+		}
+	}
+}
+
+func (s *Spool) release(id string) {
+	s.mu.Lock()
+	delete(s.inflight, id)
+	s.mu.Unlock()
+}
+
+// deliver 投递单封邮件，并根据结果删除、重试或移入 failed 目录
+func (s *Spool) deliver(id string) {
+	// 重新读取元数据，扫描之后邮件可能已经被其它 worker 处理完
+	e, err := readMeta(s.path(id, metaExt))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("spool: read %s error: %v", id, err)
+		}
+		s.forget(id)
+		return
+	}
+	if e.NextAttempt.After(time.Now()) {
+		s.retryAt(id, e.NextAttempt)
+		return
+	}
+
+	err = s.dispatch(e)
+	if err == nil {
+		s.remove(e.ID)
+		s.forget(e.ID)
+		return
+	}
+
+	// Dispatcher 队列已满不是投递失败，稍后再投递，不计入重试次数
+	if errors.Is(err, dispatcher.ErrQueueFull) {
+		s.retryAt(e.ID, time.Now().Add(queueFullDelay))
+		return
+	}
+
+	// 关闭过程中失败的投递不计入重试次数，下次启动重新投递
+	if s.closing() && !types.IsPermanent(err) {
+		log.Printf("spool: mail %s left in spool during shutdown: %v", e.MailID, err)
+		return
+	}
+
+	e.Attempts++
+	e.LastError = err.Error()
+
+	if types.IsPermanent(err) || e.Attempts >= s.maxAttempts {
+		log.Printf("spool: mail %s failed after %d attempts: %v", e.MailID, e.Attempts, err)
+		if err := s.fail(e); err != nil {
+			log.Printf("spool: move %s to failed error: %v", e.ID, err)
+		}
+		s.forget(e.ID)
+		return
+	}
+
+	e.NextAttempt = time.Now().Add(s.backoff(e.Attempts))
+	s.retryAt(e.ID, e.NextAttempt)
+	log.Printf("spool: mail %s attempt %d failed, retry at %s: %v", e.MailID, e.Attempts, e.NextAttempt.Format(time.RFC3339), err)
+	if err := s.writeMeta(e); err != nil {
+		log.Printf("spool: update %s error: %v", e.ID, err)
+	}
+}
+
+// dispatch 从磁盘还原邮件并交给下游 Dispatcher
+func (s *Spool) dispatch(e *entry) error {
+	raw, err := os.ReadFile(s.path(e.ID, rawExt))
+	if err != nil {
+		return types.Permanent(fmt.Errorf("read spooled mail error: %v", err))
+	}
+
+	mail, err := utils.RestoreMail(raw, e.MailID, e.Source, e.Envelope)
+	if err != nil {
+		return types.Permanent(fmt.Errorf("parse spooled mail error: %v", err))
+	}
+
+	return s.next.Dispatch(mail)
+}
+
+// backoff 计算第 attempts 次失败后的等待时间
+func (s *Spool) backoff(attempts int) time.Duration {
+	d := s.retryBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= s.maxBackoff {
+			return s.maxBackoff
+		}
+	}
+	return d
+}
+
+// load 启动时读取上次未投递完的邮件
+func (s *Spool) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+metaExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		e, err := readMeta(name)
+		if err != nil {
+			log.Printf("spool: read %s error: %v", name, err)
+			continue
+		}
+		s.items[e.ID] = &item{createdAt: e.CreatedAt, nextAttempt: e.NextAttempt}
+	}
+	return nil
+}
+
+// cleanOrphans 删除没有元数据的原文和崩溃时留下的临时文件，
+// 这些邮件没有确认接收，发件方会重发
+func (s *Spool) cleanOrphans() error {
+	for _, pattern := range []string{"*.tmp", filepath.Join(failedDir, "*.tmp")} {
+		names, err := filepath.Glob(filepath.Join(s.dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+rawExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		meta := strings.TrimSuffix(name, rawExt) + metaExt
+		if _, err := os.Stat(meta); os.IsNotExist(err) {
+			os.Remove(name)
+		}
+	}
+	return nil
+}
+
+func (s *Spool) remove(id string) {
+	if err := os.Remove(s.path(id, metaExt)); err != nil && !os.IsNotExist(err) {
+		log.Printf("spool: remove %s error: %v", id, err)
+		return
+	}
+	os.Remove(s.path(id, rawExt))
+}
+
+// fail 把邮件移入 failed 目录，保留原文和最后的错误
+func (s *Spool) fail(e *entry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(s.dir, failedDir, e.ID+metaExt), data); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path(e.ID, rawExt), filepath.Join(s.dir, failedDir, e.ID+rawExt)); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Join(s.dir, failedDir)); err != nil {
+		return err
+	}
+	return os.Remove(s.path(e.ID, metaExt))
+}
+
+func (s *Spool) writeMeta(e *entry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.path(e.ID, metaExt), data)
+}
+
+func (s *Spool) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+func readMeta(name string) (*entry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// writeFileSync 原子写入文件：先写临时文件并 fsync，再重命名，
+// 最后 fsync 所在目录，保证重命名在断电后仍然有效
+func writeFileSync(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir fsync 目录，使其中新建、重命名的文件持久化
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newID 生成按时间排序的唯一 ID
+func newID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate id error: %v", err)
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
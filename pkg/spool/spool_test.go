@@ -0,0 +1,252 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iamlongalong/listenmail/pkg/dispatcher"
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// testDispatcher 记录投递的邮件，handle 决定每次投递的结果
+type testDispatcher struct {
+	mu     sync.Mutex
+	mails  []string
+	handle func(mail *types.Mail) error
+}
+
+func (d *testDispatcher) Dispatch(mail *types.Mail) error {
+	var err error
+	if d.handle != nil {
+		err = d.handle(mail)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mails = append(d.mails, mail.ID)
+	return err
+}
+
+func (d *testDispatcher) AddHandlers(...types.Handler) error    { return nil }
+func (d *testDispatcher) RemoveHandlers(...types.Handler) error { return nil }
+
+func (d *testDispatcher) delivered() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.mails...)
+}
+
+func newTestMail(id string) *types.Mail {
+	return &types.Mail{
+		ID:     id,
+		Source: "test",
+		Raw:    []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: " + id + "\r\n\r\nhello\r\n"),
+	}
+}
+
+func newTestSpool(t *testing.T, config types.SpoolConfig, d types.Dispatcher, opts ...Option) *Spool {
+	t.Helper()
+	if config.Dir == "" {
+		config.Dir = t.TempDir()
+	}
+	s, err := New(config, d, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// waitFor 等待 cond 成立，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// blockingDispatcher 在 release 关闭前阻塞每次投递
+func blockingDispatcher() (*testDispatcher, chan struct{}) {
+	release := make(chan struct{})
+	return &testDispatcher{handle: func(*types.Mail) error {
+		<-release
+		return nil
+	}}, release
+}
+
+func TestQueueLimitReject(t *testing.T) {
+	d, release := blockingDispatcher()
+	s := newTestSpool(t, types.SpoolConfig{}, d, WithWorkers(1), WithQueueLimit(2, dispatcher.QueueFullReject))
+
+	for i := 1; i <= 2; i++ {
+		if err := s.Dispatch(newTestMail(fmt.Sprintf("mail-%d", i))); err != nil {
+			t.Fatalf("Dispatch mail-%d: %v", i, err)
+		}
+	}
+	if err := s.Dispatch(newTestMail("mail-3")); !errors.Is(err, dispatcher.ErrQueueFull) {
+		t.Fatalf("Dispatch mail-3 error = %v, want ErrQueueFull", err)
+	}
+
+	close(release)
+	waitFor(t, "queue to drain", func() bool { return len(d.delivered()) == 2 })
+	if err := s.Dispatch(newTestMail("mail-3")); err != nil {
+		t.Fatalf("Dispatch mail-3 after drain: %v", err)
+	}
+	waitFor(t, "mail-3", func() bool { return len(d.delivered()) == 3 })
+}
+
+func TestQueueLimitBlock(t *testing.T) {
+	d, release := blockingDispatcher()
+	s := newTestSpool(t, types.SpoolConfig{}, d, WithWorkers(1), WithQueueLimit(1, dispatcher.QueueFullBlock))
+
+	if err := s.Dispatch(newTestMail("mail-1")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Dispatch(newTestMail("mail-2")) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Dispatch returned %v while the queue was full", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Dispatch mail-2: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dispatch still blocked after the queue drained")
+	}
+	waitFor(t, "both mails", func() bool { return len(d.delivered()) == 2 })
+}
+
+func TestQueueLimitSpill(t *testing.T) {
+	d, release := blockingDispatcher()
+	s := newTestSpool(t, types.SpoolConfig{}, d, WithWorkers(1), WithQueueLimit(1, dispatcher.QueueFullSpill))
+
+	for i := 1; i <= 5; i++ {
+		if err := s.Dispatch(newTestMail(fmt.Sprintf("mail-%d", i))); err != nil {
+			t.Fatalf("Dispatch mail-%d: %v", i, err)
+		}
+	}
+	close(release)
+	waitFor(t, "all mails", func() bool { return len(d.delivered()) == 5 })
+}
+
+// spooled 返回目录中落盘的邮件原文和元数据文件
+func spooled(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	for _, ext := range []string{rawExt, metaExt} {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, matches...)
+	}
+	return names
+}
+
+func TestRecoverAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	// 第一次运行时投递被关闭打断，邮件留在磁盘上
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	first := &testDispatcher{handle: func(*types.Mail) error {
+		started <- struct{}{}
+		<-release
+		return errors.New("interrupted")
+	}}
+	s, err := New(types.SpoolConfig{Dir: dir, MaxAttempts: 1}, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Dispatch(newTestMail("mail-1")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	waitFor(t, "shutdown", s.closing)
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(spooled(t, dir)); n != 2 {
+		t.Fatalf("spooled files after shutdown = %d, want 2", n)
+	}
+
+	// 重启后继续投递，中断的投递不计入重试次数
+	second := &testDispatcher{}
+	newTestSpool(t, types.SpoolConfig{Dir: dir, MaxAttempts: 1}, second)
+	waitFor(t, "redelivery", func() bool { return len(second.delivered()) == 1 })
+	if got := second.delivered()[0]; got != "mail-1" {
+		t.Fatalf("redelivered %q, want mail-1", got)
+	}
+	waitFor(t, "spool cleanup", func() bool { return len(spooled(t, dir)) == 0 })
+}
+
+func TestMaxAttemptsMovesToFailed(t *testing.T) {
+	dir := t.TempDir()
+	d := &testDispatcher{handle: func(*types.Mail) error { return errors.New("handler down") }}
+	s := newTestSpool(t, types.SpoolConfig{Dir: dir, MaxAttempts: 3, RetryBackoff: 10 * time.Millisecond}, d)
+
+	if err := s.Dispatch(newTestMail("mail-1")); err != nil {
+		t.Fatal(err)
+	}
+	failed := filepath.Join(dir, failedDir)
+	waitFor(t, "mail in failed/", func() bool { return len(spooled(t, failed)) == 2 })
+
+	if n := len(spooled(t, dir)); n != 0 {
+		t.Errorf("spooled files = %d, want 0", n)
+	}
+	if n := len(d.delivered()); n != 3 {
+		t.Errorf("delivery attempts = %d, want 3", n)
+	}
+	metas, _ := filepath.Glob(filepath.Join(failed, "*"+metaExt))
+	e, err := readMeta(metas[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Attempts != 3 || e.LastError != "handler down" || e.MailID != "mail-1" {
+		t.Errorf("failed entry = %+v", e)
+	}
+	if _, err := os.Stat(filepath.Join(failed, e.ID+rawExt)); err != nil {
+		t.Errorf("raw mail not kept in failed/: %v", err)
+	}
+}
+
+func TestQueueFullDoesNotCountAttempt(t *testing.T) {
+	dir := t.TempDir()
+	var calls int
+	d := &testDispatcher{handle: func(*types.Mail) error {
+		calls++
+		if calls == 1 {
+			return dispatcher.ErrQueueFull
+		}
+		return nil
+	}}
+	// 只允许一次尝试，ErrQueueFull 若计入次数邮件就会进入 failed/
+	s := newTestSpool(t, types.SpoolConfig{Dir: dir, MaxAttempts: 1}, d, WithWorkers(1))
+
+	if err := s.Dispatch(newTestMail("mail-1")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delivery after queue full", func() bool { return len(d.delivered()) == 2 })
+	waitFor(t, "spool cleanup", func() bool { return len(spooled(t, dir)) == 0 })
+	if n := len(spooled(t, filepath.Join(dir, failedDir))); n != 0 {
+		t.Errorf("failed files = %d, want 0", n)
+	}
+}
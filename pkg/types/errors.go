@@ -0,0 +1,84 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDrop is returned by a handler to drop a mail: the mail counts as handled
+// and is not dispatched to the remaining handlers.
+var ErrDrop = errors.New("mail dropped")
+
+// PermanentError marks a handler error as a permanent rejection.
+// SMTP sources reply 5xx for permanent errors and 4xx for every other error,
+// so senders only drop a mail when a handler explicitly rejects it.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err as a PermanentError
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether any error in err's chain is a PermanentError.
+// HandlerErrors is permanent only when every handler failed permanently.
+func IsPermanent(err error) bool {
+	var multi HandlerErrors
+	if errors.As(err, &multi) {
+		for _, e := range multi {
+			if !IsPermanent(e) {
+				return false
+			}
+		}
+		return len(multi) > 0
+	}
+
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// HandlerError is an error returned by a single handler
+type HandlerError struct {
+	Handler string
+	Err     error
+}
+
+func (e *HandlerError) Error() string {
+	return e.Handler + ": " + e.Err.Error()
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// HandlerErrors collects the errors of every failing handler
+type HandlerErrors []*HandlerError
+
+func (e HandlerErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d handler(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// HandlerName returns the name of a handler: its Name() if implemented, otherwise its type
+func HandlerName(h Handler) string {
+	if n, ok := h.(NamedHandler); ok && n.Name() != "" {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", h)
+}
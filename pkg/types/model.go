@@ -25,6 +25,7 @@ type DBMail struct {
 	XPriority               string    `gorm:"type:text"`
 	Importance              string    `gorm:"type:text"`
 	RawHeaders              string    `gorm:"type:text"`
+	Raw                     []byte    `gorm:"type:blob"` // 原始邮件内容，用于导出和重放
 
 	// Relations
 	From        []DBAddress    `gorm:"foreignKey:MailID;constraint:OnDelete:CASCADE"`
@@ -35,6 +36,27 @@ type DBMail struct {
 
 	// Source
 	Source string `gorm:"type:text"`
+	MailID string `gorm:"index;type:text"` // 邮件源分配的 ID，关联处理记录
+	Tags   string `gorm:"index;type:text"` // 多个标签以逗号分隔
+
+	// Envelope
+	EnvelopeFrom string `gorm:"index;type:text"`
+	EnvelopeTo   string `gorm:"index;type:text"` // 多个收件人以逗号分隔
+	RemoteAddr   string `gorm:"type:text"`
+	Helo         string `gorm:"type:text"`
+	TLS          bool
+	ReceivedAt   time.Time `gorm:"index"`
+	Folder       string    `gorm:"index;type:text"`
+}
+
+// Models lists every table stored in the database
+func Models() []interface{} {
+	return []interface{}{&DBMail{}, &DBAddress{}, &DBAttachment{}, &DBDeadLetter{}, &DBProcessing{}, &DBSyncCursor{}, &DBSyncSeen{}}
+}
+
+// Migrate creates or updates every table in the database
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(Models()...)
 }
 
 // DBAddress represents an email address in database
@@ -56,6 +78,132 @@ type DBAttachment struct {
 	Path        string `gorm:"type:text"`
 }
 
+// Dead letter status
+const (
+	DeadLetterRetrying = "retrying"
+	DeadLetterDead     = "dead"
+)
+
+// DBDeadLetter represents a failed handler invocation in database
+// 重试中的记录状态为 retrying，超过最大次数后为 dead
+type DBDeadLetter struct {
+	gorm.Model
+	MailID        string `gorm:"index;type:text"`
+	Subject       string `gorm:"type:text"`
+	Source        string `gorm:"type:text"`
+	Envelope      string `gorm:"type:text"` // JSON
+	Handler       string `gorm:"index;type:text"`
+	Raw           []byte `gorm:"type:blob"`
+	Attempts      int
+	LastError     string    `gorm:"type:text"`
+	Status        string    `gorm:"index;type:text"`
+	NextAttemptAt time.Time `gorm:"index"`
+}
+
+// Processing outcomes
+const (
+	ProcessingSuccess  = "success"
+	ProcessingFailed   = "failed"
+	ProcessingSkipped  = "skipped"  // 条件不匹配
+	ProcessingDisabled = "disabled" // 处理器已暂停
+	ProcessingDropped  = "dropped"  // 处理器丢弃了邮件，后续处理器不再执行
+)
+
+// DBProcessing represents one handler's result for a mail in database
+// 每次分发（包括重试）都会为每个处理器写入一条记录
+type DBProcessing struct {
+	gorm.Model
+	MailID   string `gorm:"index;type:text"`
+	Source   string `gorm:"index;type:text"`
+	Handler  string `gorm:"index;type:text"`
+	Attempt  int    // 1 为首次分发，每次重试加 1
+	Matched  bool
+	Duration time.Duration
+	Outcome  string `gorm:"index;type:text"`
+	Error    string `gorm:"type:text"`
+}
+
+// DBSyncCursor represents the sync progress of a mail source in database
+// IMAP 每个文件夹一条记录，POP3 和 MailHog 的 Folder 为空，记录存在表示首次同步已完成
+type DBSyncCursor struct {
+	ID          uint   `gorm:"primarykey"`
+	Source      string `gorm:"uniqueIndex:idx_sync_cursor;type:text"`
+	Folder      string `gorm:"uniqueIndex:idx_sync_cursor;type:text"`
+	UIDValidity uint32
+	LastUID     uint32
+	UpdatedAt   time.Time
+}
+
+// DBSyncSeen represents a message already handled by a POP3 (UIDL) or MailHog source in database
+type DBSyncSeen struct {
+	ID        uint   `gorm:"primarykey"`
+	Source    string `gorm:"uniqueIndex:idx_sync_seen;type:text"`
+	MessageID string `gorm:"uniqueIndex:idx_sync_seen;type:text"`
+	CreatedAt time.Time
+}
+
+// APIProcessing represents a processing record in API responses
+type APIProcessing struct {
+	ID         int64     `json:"id"`
+	MailID     string    `json:"mail_id"`
+	Source     string    `json:"source"`
+	Handler    string    `json:"handler"`
+	Attempt    int       `json:"attempt"`
+	Matched    bool      `json:"matched"`
+	DurationMS float64   `json:"duration_ms"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ToAPIProcessing converts DBProcessing to APIProcessing
+func (p *DBProcessing) ToAPIProcessing() *APIProcessing {
+	return &APIProcessing{
+		ID:         int64(p.ID),
+		MailID:     p.MailID,
+		Source:     p.Source,
+		Handler:    p.Handler,
+		Attempt:    p.Attempt,
+		Matched:    p.Matched,
+		DurationMS: float64(p.Duration) / float64(time.Millisecond),
+		Outcome:    p.Outcome,
+		Error:      p.Error,
+		CreatedAt:  p.CreatedAt,
+	}
+}
+
+// APIDeadLetter represents a dead letter in API responses
+type APIDeadLetter struct {
+	ID            int64     `json:"id"`
+	MailID        string    `json:"mail_id"`
+	Subject       string    `json:"subject"`
+	Source        string    `json:"source"`
+	Handler       string    `json:"handler"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	Status        string    `json:"status"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ToAPIDeadLetter converts DBDeadLetter to APIDeadLetter
+func (d *DBDeadLetter) ToAPIDeadLetter() *APIDeadLetter {
+	return &APIDeadLetter{
+		ID:            int64(d.ID),
+		MailID:        d.MailID,
+		Subject:       d.Subject,
+		Source:        d.Source,
+		Handler:       d.Handler,
+		Attempts:      d.Attempts,
+		LastError:     d.LastError,
+		Status:        d.Status,
+		NextAttemptAt: d.NextAttemptAt,
+		CreatedAt:     d.CreatedAt,
+		UpdatedAt:     d.UpdatedAt,
+	}
+}
+
 // ToAPIMail converts DBMail to APIMail
 func (m *DBMail) ToAPIMail() *APIMail {
 	api := &APIMail{
@@ -76,6 +224,9 @@ func (m *DBMail) ToAPIMail() *APIMail {
 		RawHeaders:              m.RawHeaders,
 		CreatedAt:               m.CreatedAt,
 		Source:                  m.Source,
+		MailID:                  m.MailID,
+		Tags:                    splitList(m.Tags),
+		Envelope:                ToAPIEnvelope(m.Envelope()),
 	}
 
 	// Convert addresses
@@ -127,11 +278,21 @@ func FromMail(m *Mail) *DBMail {
 		TextContent:             m.Text,
 		HTMLContent:             m.HTML,
 		Source:                  m.Source,
+		MailID:                  m.ID,
+		Tags:                    strings.Join(m.Tags, ","),
+		Raw:                     m.Raw,
 		ContentTransferEncoding: getFirstHeader(m.Headers, "Content-Transfer-Encoding"),
 		ContentType:             getFirstHeader(m.Headers, "Content-Type"),
 		Priority:                getFirstHeader(m.Headers, "Priority"),
 		XPriority:               getFirstHeader(m.Headers, "X-Priority"),
 		Importance:              getFirstHeader(m.Headers, "Importance"),
+		EnvelopeFrom:            m.Envelope.From,
+		EnvelopeTo:              strings.Join(m.Envelope.To, ","),
+		RemoteAddr:              m.Envelope.RemoteAddr,
+		Helo:                    m.Envelope.Helo,
+		TLS:                     m.Envelope.TLS,
+		ReceivedAt:              m.Envelope.ReceivedAt,
+		Folder:                  m.Envelope.Folder,
 	}
 
 	// Convert ReplyTo
@@ -200,9 +361,33 @@ func FromMail(m *Mail) *DBMail {
 	return dbMail
 }
 
+// Envelope rebuilds the Envelope stored in DBMail
+func (m *DBMail) Envelope() Envelope {
+	env := Envelope{
+		From:       m.EnvelopeFrom,
+		RemoteAddr: m.RemoteAddr,
+		Helo:       m.Helo,
+		TLS:        m.TLS,
+		ReceivedAt: m.ReceivedAt,
+		Folder:     m.Folder,
+	}
+	if m.EnvelopeTo != "" {
+		env.To = strings.Split(m.EnvelopeTo, ",")
+	}
+	return env
+}
+
 func getFirstHeader(headers map[string][]string, key string) string {
 	if values := headers[key]; len(values) > 0 {
 		return values[0]
 	}
 	return ""
 }
+
+// splitList splits a comma separated column, an empty column gives an empty list
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
@@ -1,7 +1,9 @@
 package types
 
 import (
+	"context"
 	"fmt"
+	"path"
 	"strings"
 	"time"
 
@@ -26,7 +28,80 @@ type Mail struct {
 	Attachments []Attachment
 	Headers     map[string][]string
 
-	Source string
+	Source   string
+	Envelope Envelope
+	Tags     []string // 规则中 tag 动作添加的标签
+
+	Raw []byte // 原始邮件内容（RFC 5322）
+}
+
+// Clone 返回邮件的深拷贝，修改拷贝不影响原邮件
+func (m *Mail) Clone() *Mail {
+	c := *m
+	c.From = cloneAddresses(m.From)
+	c.To = cloneAddresses(m.To)
+	c.Cc = cloneAddresses(m.Cc)
+	c.Bcc = cloneAddresses(m.Bcc)
+	c.ReplyTo = cloneAddresses(m.ReplyTo)
+	c.InReplyTo = cloneStrings(m.InReplyTo)
+	c.References = cloneStrings(m.References)
+	if m.Attachments != nil {
+		c.Attachments = make([]Attachment, len(m.Attachments))
+		for i, a := range m.Attachments {
+			a.Data = cloneBytes(a.Data)
+			a.Header = a.Header.Copy()
+			c.Attachments[i] = a
+		}
+	}
+	if m.Headers != nil {
+		c.Headers = make(map[string][]string, len(m.Headers))
+		for k, v := range m.Headers {
+			c.Headers[k] = cloneStrings(v)
+		}
+	}
+	c.Envelope.To = cloneStrings(m.Envelope.To)
+	c.Tags = cloneStrings(m.Tags)
+	c.Raw = cloneBytes(m.Raw)
+	return &c
+}
+
+func cloneAddresses(addrs []*mail.Address) []*mail.Address {
+	if addrs == nil {
+		return nil
+	}
+	c := make([]*mail.Address, len(addrs))
+	for i, addr := range addrs {
+		if addr != nil {
+			a := *addr
+			c[i] = &a
+		}
+	}
+	return c
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// Envelope represents the transport envelope of a mail
+type Envelope struct {
+	From       string    // MAIL FROM（或 Return-Path）
+	To         []string  // RCPT TO（或 Delivered-To / X-Original-To）
+	RemoteAddr string    // SMTP 客户端地址，或拉取邮件的服务器地址
+	Helo       string    // HELO/EHLO 名称
+	TLS        bool      // 传输是否使用了 TLS
+	ReceivedAt time.Time // 本服务收到邮件的时间
+	Folder     string    // 拉取邮件的 IMAP 文件夹，其它邮件源为空
 }
 
 // Attachment represents an email attachment
@@ -55,6 +130,42 @@ type Handler interface {
 	Match(mail *Mail) bool
 }
 
+// NamedHandler is a Handler with a name. The name identifies the handler in
+// config, logs, processing records and the handlers API, so it must be unique
+// within a dispatcher. Handlers without a name are identified by their type,
+// with a #2, #3... suffix when several handlers of the same type are registered.
+type NamedHandler interface {
+	Handler
+	// Name returns the handler name
+	Name() string
+}
+
+// HandlerInfo describes a handler registered in a dispatcher
+type HandlerInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// SourceStatus describes the connection state of a running source
+type SourceStatus struct {
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Connected   bool       `json:"connected"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	LastPollAt  *time.Time `json:"last_poll_at,omitempty"` // 最后一次成功检查新邮件的时间
+	Reconnects  int        `json:"reconnects"`             // 连接断开后重新连接成功的次数
+}
+
+// ContextHandler is a Handler that supports timeouts and cancellation.
+// Dispatchers call HandleContext instead of Handle when a handler implements it.
+type ContextHandler interface {
+	Handler
+	// HandleContext processes a mail message, giving up when ctx is done
+	HandleContext(ctx context.Context, mail *Mail) error
+}
+
 // Dispatcher manages mail handlers and dispatches mails to matching handlers
 type Dispatcher interface {
 	// AddHandler adds a new mail handler
@@ -69,12 +180,18 @@ type ConfigFile struct {
 	Server struct {
 		Addr string `yaml:"addr"`
 
-		Username string `yaml:"username"`
-		Password string `yaml:"password"`
+		Username     string `yaml:"username"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"password_file"` // 从文件读取密码，与 password 二选一
 	} `yaml:"server"`
 	Save struct {
 		Dir string `yaml:"dir"`
+		// RulesOnly 为 true 时不再保存所有邮件，只保存规则中 save 动作匹配的邮件
+		RulesOnly bool `yaml:"rules_only"`
 	} `yaml:"save"`
+	Spool      SpoolConfig      `yaml:"spool"`
+	Dispatcher DispatcherConfig `yaml:"dispatcher"`
+	Rules      []*RuleConfig    `yaml:"rules,omitempty"`
 
 	Sources struct {
 		// 各个源的具体配置
@@ -85,6 +202,98 @@ type ConfigFile struct {
 	} `yaml:"sources"`
 }
 
+// SpoolConfig represents the on-disk spool configuration
+type SpoolConfig struct {
+	Dir          string        `yaml:"dir"` // 默认为 save.dir/spool
+	MaxAttempts  int           `yaml:"max_attempts"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+// DispatcherConfig represents the dispatcher configuration
+type DispatcherConfig struct {
+	Workers            int                      `yaml:"workers"`             // 并发 worker 数量，默认 10，spool 以同样数量投递
+	QueueSize          int                      `yaml:"queue_size"`          // 队列长度，默认 100，serve 中为 spool 中等待的邮件数量
+	QueueFullPolicy    string                   `yaml:"queue_full_policy"`   // block、reject 或 spill，默认 block
+	HandlerConcurrency map[string]int           `yaml:"handler_concurrency"` // 处理器名称 -> 最大并发数
+	HandlerTimeout     time.Duration            `yaml:"handler_timeout"`     // 处理器默认超时时间，0 表示不限制
+	HandlerTimeouts    map[string]time.Duration `yaml:"handler_timeouts"`    // 处理器名称 -> 超时时间
+	ShutdownTimeout    time.Duration            `yaml:"shutdown_timeout"`    // 退出时等待队列排空的最长时间，默认 30s
+
+	Retry RetryConfig `yaml:"retry"`
+}
+
+// RetryConfig represents the per-handler retry policy
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"` // 超过后进入死信
+	Backoff     time.Duration `yaml:"backoff"`      // 首次重试间隔，之后指数增长
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+}
+
+// RuleConfig represents a declarative routing rule.
+// The rule is registered as a handler named Name; when the condition matches,
+// its actions run in order and the first failing action fails the rule.
+type RuleConfig struct {
+	Name    string          `yaml:"name"`
+	When    ConditionConfig `yaml:"when"`
+	Actions []*ActionConfig `yaml:"actions"`
+}
+
+// ConditionConfig represents a rule condition.
+// Every field that is set must match (and); and/or/not nest other conditions.
+// Patterns are regular expressions, an empty condition matches every mail.
+type ConditionConfig struct {
+	And []*ConditionConfig `yaml:"and,omitempty"`
+	Or  []*ConditionConfig `yaml:"or,omitempty"`
+	Not *ConditionConfig   `yaml:"not,omitempty"`
+
+	From       string            `yaml:"from,omitempty"`
+	To         string            `yaml:"to,omitempty"`
+	Cc         string            `yaml:"cc,omitempty"`
+	Subject    string            `yaml:"subject,omitempty"`
+	Header     map[string]string `yaml:"header,omitempty"`     // 头部名称 -> 正则
+	Attachment string            `yaml:"attachment,omitempty"` // 附件文件名
+	Content    string            `yaml:"content,omitempty"`    // 纯文本或 HTML 内容
+	Source     string            `yaml:"source,omitempty"`     // 邮件源名称
+	Folder     string            `yaml:"folder,omitempty"`     // IMAP 文件夹
+	DateAfter  time.Time         `yaml:"date_after,omitempty"`
+	DateBefore time.Time         `yaml:"date_before,omitempty"`
+	MinSize    int64             `yaml:"min_size,omitempty"` // 原始邮件字节数
+	MaxSize    int64             `yaml:"max_size,omitempty"`
+	Expr       string            `yaml:"expr,omitempty"` // 表达式，见 handlers.ExprMail
+}
+
+// Rule action types
+const (
+	ActionSave    = "save"
+	ActionForward = "forward"
+	ActionWebhook = "webhook"
+	ActionExec    = "exec"
+	ActionTag     = "tag"
+	ActionDrop    = "drop"
+)
+
+// ActionConfig represents an action of a rule, only the fields of its type are used
+type ActionConfig struct {
+	Type string `yaml:"type"` // save、forward、webhook、exec、tag 或 drop
+
+	// forward：通过 SMTP 服务器转发原始邮件
+	Server   string   `yaml:"server,omitempty"` // host:port
+	From     string   `yaml:"from,omitempty"`   // MAIL FROM，默认为原信封发件人
+	To       []string `yaml:"to,omitempty"`
+	Username string   `yaml:"username,omitempty"`
+	Password string   `yaml:"password,omitempty"`
+
+	// webhook：以 JSON 格式 POST 邮件
+	URL     string            `yaml:"url,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// exec：执行命令，原始邮件写入 stdin
+	Command []string `yaml:"command,omitempty"`
+
+	// tag：给邮件添加标签，save 时一起保存
+	Tags []string `yaml:"tags,omitempty"`
+}
+
 // SMTPConfig represents SMTP server configuration
 type SMTPConfig struct {
 	Name    string `yaml:"name"`
@@ -97,6 +306,28 @@ type SMTPConfig struct {
 	MaxMessageBytes   int64         `yaml:"max_message_bytes"`
 	MaxRecipients     int           `yaml:"max_recipients"`
 	AllowInsecureAuth bool          `yaml:"allow_insecure_auth"`
+
+	// SMTP AUTH 账号，UsersFile 为 htpasswd 格式的账号文件
+	Users       []SMTPUser `yaml:"users,omitempty"`
+	UsersFile   string     `yaml:"users_file"`
+	RequireAuth bool       `yaml:"require_auth"`
+
+	// 允许接收的收件域名和收件地址，支持 * 通配符，均为空时接收所有收件人
+	AcceptedDomains    []string `yaml:"accepted_domains,omitempty"`
+	AcceptedRecipients []string `yaml:"accepted_recipients,omitempty"`
+
+	// TLS 证书配置，配置后提供 STARTTLS；ImplicitTLS 为 SMTPS 模式（通常为 465 端口）
+	TLSCert     string `yaml:"tls_cert"`
+	TLSKey      string `yaml:"tls_key"`
+	ImplicitTLS bool   `yaml:"implicit_tls"`
+	RequireTLS  bool   `yaml:"require_tls"`
+}
+
+// SMTPUser represents an account accepted by SMTP AUTH
+type SMTPUser struct {
+	Username string `yaml:"username"`
+	// Password 可以是明文，也可以是 bcrypt 哈希（以 $2a$、$2b$、$2y$ 开头）
+	Password string `yaml:"password"`
 }
 
 // IMAPConfig represents IMAP client configuration
@@ -104,11 +335,61 @@ type IMAPConfig struct {
 	Name    string `yaml:"name"`
 	Enabled bool   `yaml:"enabled"`
 
-	Server   string        `yaml:"server"`
-	Username string        `yaml:"username"`
-	Password string        `yaml:"password"`
-	TLS      bool          `yaml:"tls"`
-	Interval time.Duration `yaml:"check_interval"`
+	Server       string        `yaml:"server"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	PasswordFile string        `yaml:"password_file"` // 从文件读取密码，与 password 二选一
+	TLS          bool          `yaml:"tls"`
+	Interval     time.Duration `yaml:"check_interval"`
+
+	// 使用 OAuth2 令牌登录（SASL XOAUTH2/OAUTHBEARER），设置后不使用 password
+	OAuth2 *OAuth2Config `yaml:"oauth2"`
+
+	// 监听的文件夹，默认为 INBOX。支持 LIST 通配符：* 匹配任意字符（包括子文件夹），% 不匹配子文件夹
+	Folders []string `yaml:"folders,omitempty"`
+
+	// 服务器支持 IDLE 时等待新邮件推送，不支持或 DisableIdle 时按 Interval 轮询
+	DisableIdle bool `yaml:"disable_idle"`
+
+	// 首次同步（或 UIDVALIDITY 改变后）的起点：all、now 或日期，见 ParseStartFrom
+	StartFrom string `yaml:"start_from"`
+
+	// 只获取符合条件的新邮件
+	Search IMAPSearchConfig `yaml:"search"`
+
+	// 邮件分发成功后执行的操作
+	Actions IMAPActionsConfig `yaml:"actions"`
+}
+
+// IMAPSearchConfig 是获取邮件时的搜索条件，条件之间为 AND，由服务器的 SEARCH 命令匹配
+type IMAPSearchConfig struct {
+	Unseen  bool   `yaml:"unseen"`  // 只获取未读邮件
+	From    string `yaml:"from"`    // From 头包含该字符串
+	To      string `yaml:"to"`      // To 头包含该字符串
+	Subject string `yaml:"subject"` // 主题包含该字符串
+	Since   string `yaml:"since"`   // 服务器接收日期不早于该日期，格式 2006-01-02
+}
+
+// SinceDate 解析 Since，未设置时返回零值
+func (c *IMAPSearchConfig) SinceDate() (time.Time, error) {
+	if c.Since == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", c.Since, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected 2006-01-02", c.Since)
+	}
+	return t, nil
+}
+
+// IMAPActionsConfig 是邮件分发成功后对服务器上的邮件执行的操作，按字段顺序执行。
+// 分发失败或被处理器拒绝的邮件保持不变
+type IMAPActionsConfig struct {
+	Peek   bool     `yaml:"peek"`    // 获取邮件时不设置 \Seen（BODY.PEEK），默认获取即已读
+	Seen   bool     `yaml:"seen"`    // 设置 \Seen，配合 peek 使邮件在处理成功后才变为已读
+	Flags  []string `yaml:"flags"`   // 添加标记或关键字，如 \Flagged、$Processed
+	MoveTo string   `yaml:"move_to"` // 移动到该文件夹
+	Delete bool     `yaml:"delete"`  // 设置 \Deleted 并 EXPUNGE
 }
 
 // POP3Config represents POP3 client configuration
@@ -116,11 +397,52 @@ type POP3Config struct {
 	Name    string `yaml:"name"`
 	Enabled bool   `yaml:"enabled"`
 
-	Server   string        `yaml:"server"`
-	Username string        `yaml:"username"`
-	Password string        `yaml:"password"`
-	TLS      bool          `yaml:"tls"`
-	Interval time.Duration `yaml:"check_interval"`
+	Server       string        `yaml:"server"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	PasswordFile string        `yaml:"password_file"` // 从文件读取密码，与 password 二选一
+	TLS          bool          `yaml:"tls"`
+	Interval     time.Duration `yaml:"check_interval"`
+
+	// 使用 OAuth2 令牌登录（AUTH XOAUTH2/OAUTHBEARER），设置后不使用 password
+	OAuth2 *OAuth2Config `yaml:"oauth2"`
+
+	// 首次同步的起点：all、now 或日期，见 ParseStartFrom
+	StartFrom string `yaml:"start_from"`
+}
+
+// SASL 机制名称
+const (
+	OAuth2MechanismXOAuth2     = "XOAUTH2"
+	OAuth2MechanismOAuthBearer = "OAUTHBEARER"
+)
+
+// OAuth2Config 是 IMAP 和 POP3 的 OAuth2 登录配置。令牌的来源三选一：
+// token 固定令牌，token_file 每次登录时读取的令牌文件（由其他程序负责刷新），
+// refresh_token 向 token_url 换取访问令牌，过期前自动刷新。
+// client_secret 和 refresh_token 也可以通过 *_file 从文件读取
+type OAuth2Config struct {
+	Mechanism string `yaml:"mechanism"` // XOAUTH2（默认）或 OAUTHBEARER
+
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+
+	TokenURL     string   `yaml:"token_url"` // 令牌端点，如 https://oauth2.googleapis.com/token
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RefreshToken string   `yaml:"refresh_token"`
+	Scopes       []string `yaml:"scopes,omitempty"`
+
+	ClientSecretFile string `yaml:"client_secret_file"`
+	RefreshTokenFile string `yaml:"refresh_token_file"`
+}
+
+// SetDefaults 填充未设置的字段
+func (c *OAuth2Config) SetDefaults() {
+	c.Mechanism = strings.ToUpper(c.Mechanism)
+	if c.Mechanism == "" {
+		c.Mechanism = OAuth2MechanismXOAuth2
+	}
 }
 
 // MailHogConfig represents MailHog API client configuration
@@ -130,6 +452,118 @@ type MailHogConfig struct {
 
 	APIURL   string        `yaml:"api_url"`
 	Interval time.Duration `yaml:"check_interval"`
+
+	// 首次同步的起点：all、now 或日期，见 ParseStartFrom
+	StartFrom string `yaml:"start_from"`
+}
+
+// StartFrom 是邮件源首次同步的起点，之后从数据库中保存的进度继续
+type StartFrom struct {
+	Now   bool      // 只处理之后收到的邮件
+	Since time.Time // 只处理这个时间之后的邮件，零值表示全部
+}
+
+// ParseStartFrom 解析 start_from：all（默认）处理已有的全部邮件，now 跳过已有的邮件，
+// 日期（2006-01-02 或 RFC 3339）只处理该时间之后的邮件
+func ParseStartFrom(s string) (StartFrom, error) {
+	switch strings.ToLower(s) {
+	case "", "all":
+		return StartFrom{}, nil
+	case "now":
+		return StartFrom{Now: true}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return StartFrom{Since: t}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return StartFrom{Since: t}, nil
+	}
+	return StartFrom{}, fmt.Errorf("invalid start_from %q, expected all, now or a date like 2006-01-02", s)
+}
+
+// SetDefaults 填充配置中未设置的字段
+func (c *ConfigFile) SetDefaults() {
+	if c.Spool.Dir == "" {
+		c.Spool.Dir = path.Join(c.Save.Dir, "spool")
+	}
+	for _, cfg := range c.Sources.SMTP {
+		if cfg != nil {
+			cfg.SetDefaults()
+		}
+	}
+	for _, cfg := range c.Sources.IMAP {
+		if cfg != nil {
+			cfg.SetDefaults()
+		}
+	}
+	for _, cfg := range c.Sources.POP3 {
+		if cfg != nil {
+			cfg.SetDefaults()
+		}
+	}
+	for _, cfg := range c.Sources.MailHog {
+		if cfg != nil {
+			cfg.SetDefaults()
+		}
+	}
+}
+
+// SetDefaults 填充未设置的字段，ImplicitTLS 时默认监听 465 端口
+func (c *SMTPConfig) SetDefaults() {
+	if c.Address == "" {
+		c.Address = ":25"
+		if c.ImplicitTLS {
+			c.Address = ":465"
+		}
+	}
+	if c.Domain == "" {
+		c.Domain = "localhost"
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = 10 * time.Second
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+	if c.MaxMessageBytes == 0 {
+		c.MaxMessageBytes = 10 * 1024 * 1024 // 10MB
+	}
+	if c.MaxRecipients == 0 {
+		c.MaxRecipients = 50
+	}
+}
+
+// SetDefaults 填充未设置的字段
+func (c *IMAPConfig) SetDefaults() {
+	if c.Interval == 0 {
+		c.Interval = 30 * time.Second
+	}
+	if len(c.Folders) == 0 {
+		c.Folders = []string{"INBOX"}
+	}
+	if c.OAuth2 != nil {
+		c.OAuth2.SetDefaults()
+	}
+}
+
+// SetDefaults 填充未设置的字段
+func (c *POP3Config) SetDefaults() {
+	if c.Interval == 0 {
+		c.Interval = 30 * time.Second
+	}
+	if c.OAuth2 != nil {
+		c.OAuth2.SetDefaults()
+	}
+}
+
+// SetDefaults 填充未设置的字段
+func (c *MailHogConfig) SetDefaults() {
+	if c.APIURL == "" {
+		c.APIURL = "http://localhost:8025"
+	}
+	if c.Interval == 0 {
+		c.Interval = 5 * time.Second
+	}
 }
 
 // SourceType represents the type of mail source
@@ -157,6 +591,30 @@ type APIAttachment struct {
 	Path        string `json:"path"`
 }
 
+// APIEnvelope represents a mail envelope in API responses
+type APIEnvelope struct {
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	RemoteAddr string    `json:"remote_addr"`
+	Helo       string    `json:"helo"`
+	TLS        bool      `json:"tls"`
+	ReceivedAt time.Time `json:"received_at"`
+	Folder     string    `json:"folder,omitempty"`
+}
+
+// ToAPIEnvelope converts an Envelope to an APIEnvelope
+func ToAPIEnvelope(env Envelope) APIEnvelope {
+	return APIEnvelope{
+		From:       env.From,
+		To:         env.To,
+		RemoteAddr: env.RemoteAddr,
+		Helo:       env.Helo,
+		TLS:        env.TLS,
+		ReceivedAt: env.ReceivedAt,
+		Folder:     env.Folder,
+	}
+}
+
 // APIMail represents a mail record in API responses
 type APIMail struct {
 	ID                      int64           `json:"id"`
@@ -181,6 +639,9 @@ type APIMail struct {
 	Bcc                     []APIAddress    `json:"bcc"`
 	Attachments             []APIAttachment `json:"attachments"`
 	Source                  string          `json:"source"`
+	MailID                  string          `json:"mail_id"`
+	Tags                    []string        `json:"tags"`
+	Envelope                APIEnvelope     `json:"envelope"`
 }
 
 // ToAPIAddress converts a mail.Address to an APIAddress
@@ -215,6 +676,10 @@ func (m *Mail) ToAPIMail() *APIMail {
 		To:          ToAPIAddresses(m.To),
 		Cc:          ToAPIAddresses(m.Cc),
 		Bcc:         ToAPIAddresses(m.Bcc),
+		Source:      m.Source,
+		MailID:      m.ID,
+		Tags:        m.Tags,
+		Envelope:    ToAPIEnvelope(m.Envelope),
 	}
 
 	// Convert headers
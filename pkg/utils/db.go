@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// OpenDB 打开 SQLite 数据库。emails.db 同时被多个连接池写入（保存邮件、死信、处理记录、同步进度），
+// 使用 WAL 让读写互不阻塞，写入冲突时等待 busy_timeout 而不是立即返回 database is locked，
+// 事务开始时即获取写锁，避免读后写的事务升级锁失败
+func OpenDB(dbPath string) (*gorm.DB, error) {
+	return gorm.Open(sqlite.Open(dbPath+"?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate"), &gorm.Config{})
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"github.com/iamlongalong/listenmail/pkg/types"
+)
+
+// SafeMatch 调用 Match，处理器 panic 时转换为错误返回
+func SafeMatch(h types.Handler, mail *types.Mail) (matched bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("handler %s panic in Match: %v\n%s", types.HandlerName(h), r, debug.Stack())
+			matched, err = false, fmt.Errorf("panic in match: %v", r)
+		}
+	}()
+	return h.Match(mail), nil
+}
+
+// SafeHandle 调用 Handle，处理器 panic 时转换为错误返回
+func SafeHandle(h types.Handler, mail *types.Mail) error {
+	return safeCall(h, func() error { return h.Handle(mail) })
+}
+
+// SafeHandleContext 调用处理器并遵守 ctx 的超时和取消
+// 实现了 types.ContextHandler 的处理器直接收到 ctx；其它处理器在独立的 goroutine 中执行，
+// ctx 结束后不再等待，但处理器本身无法被中断，会在后台继续运行直到返回。
+// 有超时时间时后台的处理器使用邮件的拷贝，按时返回才把它对邮件的修改（如标签）写回，
+// 超时后的修改不会影响后续处理器和重试
+func SafeHandleContext(ctx context.Context, h types.Handler, mail *types.Mail) error {
+	if ch, ok := h.(types.ContextHandler); ok {
+		return safeCall(h, func() error { return ch.HandleContext(ctx, mail) })
+	}
+
+	run := mail
+	if _, ok := ctx.Deadline(); ok {
+		run = mail.Clone()
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- SafeHandle(h, run)
+	}()
+
+	select {
+	case err := <-errCh:
+		if run != mail {
+			*mail = *run
+		}
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("handler %s: %w", types.HandlerName(h), ctx.Err())
+	}
+}
+
+// safeCall 执行 fn，panic 时转换为错误返回
+func safeCall(h types.Handler, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("handler %s panic in Handle: %v\n%s", types.HandlerName(h), r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn()
+}
@@ -12,8 +12,14 @@ import (
 
 // ParseMail 将邮件消息解析为Mail结构体
 func ParseMail(r io.Reader) (*types.Mail, error) {
+	// 保留原始内容，用于落盘和重放
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
 	// 解析邮件消息
-	mr, err := mail.CreateReader(r)
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
 	if err != nil {
 		return nil, err
 	}
@@ -21,6 +27,7 @@ func ParseMail(r io.Reader) (*types.Mail, error) {
 	// 创建Mail结构体
 	m := &types.Mail{
 		Headers: make(map[string][]string),
+		Raw:     raw,
 	}
 
 	// 获取头部信息
@@ -47,6 +54,7 @@ func ParseMail(r io.Reader) (*types.Mail, error) {
 		"From", "To", "Cc", "Bcc", "Subject", "Date", "Message-ID",
 		"References", "In-Reply-To", "Reply-To", "Content-Type",
 		"Content-Transfer-Encoding", "MIME-Version",
+		"Return-Path", "Delivered-To", "X-Original-To",
 	}
 	for _, key := range commonHeaders {
 		if values := header.Values(key); len(values) > 0 {
@@ -97,6 +105,48 @@ func ParseMail(r io.Reader) (*types.Mail, error) {
 	return m, nil
 }
 
+// RestoreMail 从原始内容还原邮件，并恢复解析时无法得到的 ID、来源和信封
+func RestoreMail(raw []byte, id, source string, env types.Envelope) (*types.Mail, error) {
+	m, err := ParseMail(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	m.ID = id
+	m.Source = source
+	m.Envelope = env
+	return m, nil
+}
+
+// EnvelopeFromHeaders 从 Return-Path、Delivered-To、X-Original-To 头部推断信封信息
+// 用于 IMAP、POP3 等拿不到 SMTP 信封的邮件源
+func EnvelopeFromHeaders(m *types.Mail) types.Envelope {
+	var env types.Envelope
+	if values := m.Headers["Return-Path"]; len(values) > 0 {
+		env.From = trimAngle(values[0])
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range []string{"Delivered-To", "X-Original-To"} {
+		for _, v := range m.Headers[key] {
+			addr := trimAngle(v)
+			if addr == "" || seen[strings.ToLower(addr)] {
+				continue
+			}
+			seen[strings.ToLower(addr)] = true
+			env.To = append(env.To, addr)
+		}
+	}
+	return env
+}
+
+// trimAngle 去掉地址两侧的空白和尖括号
+func trimAngle(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "<")
+	s = strings.TrimSuffix(s, ">")
+	return s
+}
+
 // CreateMailReader 从原始邮件数据创建邮件读取器
 func CreateMailReader(data []byte) (io.Reader, error) {
 	return bytes.NewReader(data), nil